@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
@@ -38,6 +41,8 @@ var auth struct {
 
 	allowedClient []netAddr
 
+	clientCA *x509.CertPool // verify TLS client certificate
+
 	authed *TimeoutSet // cache authentication based on client ip
 
 	template *template.Template
@@ -58,21 +63,24 @@ func parseAllowedClient(val string) {
 		}
 		ip := net.ParseIP(ipAndMask[0])
 		if ip == nil {
-			Fatal("allowedClient syntax error %s: ip address not valid\n", s)
+			Fatalf("allowedClient syntax error %s: ip address not valid\n", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
 		}
-		var mask net.IPMask
+		nbit := bits
 		if len(ipAndMask) == 2 {
-			nbit, err := strconv.Atoi(ipAndMask[1])
-			if err != nil {
-				Fatal("allowedClient syntax error %s: %v\n", s, err)
+			var err error
+			if nbit, err = strconv.Atoi(ipAndMask[1]); err != nil {
+				Fatalf("allowedClient syntax error %s: %v\n", s, err)
 			}
-			if nbit > 32 {
-				Fatal("allowedClient error: mask number should <= 32")
+			if nbit < 0 || nbit > bits {
+				Fatalf("allowedClient error %s: mask number should <= %d\n", s, bits)
 			}
-			mask = NewNbitIPv4Mask(nbit)
-		} else {
-			mask = NewNbitIPv4Mask(32)
 		}
+		mask := net.CIDRMask(nbit, bits)
 		auth.allowedClient[i] = netAddr{ip.Mask(mask), mask}
 	}
 }
@@ -87,9 +95,25 @@ func parseUserPasswd(val string) {
 	auth.user, auth.passwd = arr[0], arr[1]
 }
 
+func parseClientCA(val string) {
+	if val == "" {
+		return
+	}
+	auth.required = true
+	pem, err := ioutil.ReadFile(expandTilde(val))
+	if err != nil {
+		Fatal("reading clientCA:", err)
+	}
+	auth.clientCA = x509.NewCertPool()
+	if !auth.clientCA.AppendCertsFromPEM(pem) {
+		Fatal("clientCA error: no PEM encoded certificate found in", val)
+	}
+}
+
 func initAuth() {
 	parseUserPasswd(config.UserPasswd)
 	parseAllowedClient(config.AllowedClient)
+	parseClientCA(config.ClientCA)
 
 	if !auth.required {
 		return
@@ -123,6 +147,9 @@ func Authenticate(conn *clientConn, r *Request) (err error) {
 	if authIP(clientIP) { // IP is allowed
 		return
 	}
+	if authClientCert(conn) {
+		return
+	}
 	// No user specified
 	if auth.user == "" {
 		sendErrorPage(conn, "403 Forbidden", "Access forbidden", "You are not allowed to use the proxy.")
@@ -152,6 +179,22 @@ func authIP(clientIP string) bool {
 	return false
 }
 
+// authClientCert checks whether the client has sent a certificate signed by
+// clientCA. The certificate is verified during TLS handshake.
+func authClientCert(conn *clientConn) bool {
+	tc, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return false
+	}
+	debug.Printf("client %s authed by certificate %s\n", conn.RemoteAddr(),
+		state.PeerCertificates[0].Subject.CommonName)
+	return true
+}
+
 func genNonce() string {
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "%x", time.Now().Unix())
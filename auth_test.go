@@ -46,7 +46,7 @@ func TestParseAllowedClient(t *testing.T) {
 }
 
 func TestAuthIP(t *testing.T) {
-	parseAllowedClient("192.168.0.0/16, 192.169.2.1, 10.0.0.0/8, 8.8.8.8")
+	parseAllowedClient("192.168.0.0/16, 192.169.2.1, 10.0.0.0/8, 8.8.8.8, 2001:db8::/32, ::1")
 
 	var testData = []struct {
 		ip      string
@@ -58,6 +58,11 @@ func TestAuthIP(t *testing.T) {
 		{"192.169.2.2", false},
 		{"8.8.8.8", true},
 		{"1.2.3.4", false},
+		{"::ffff:10.1.2.3", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+		{"::2", false},
 	}
 
 	for _, td := range testData {
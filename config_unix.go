@@ -10,6 +10,8 @@ const (
 	rcFname            = "rc"
 	alwaysBlockedFname = "blocked"
 	alwaysDirectFname  = "direct"
+	routeFname         = "route"
+	publicSuffixFname  = "public_suffix_list.dat"
 	statFname          = "stat"
 
 	newLine = "\n"
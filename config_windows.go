@@ -9,6 +9,8 @@ const (
 	rcFname            = "rc.txt"
 	alwaysBlockedFname = "blocked.txt"
 	alwaysDirectFname  = "direct.txt"
+	routeFname         = "route.txt"
+	publicSuffixFname  = "public_suffix_list.dat"
 	statFname          = "stat.txt"
 
 	newLine = "\r\n"
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS poisoning detection. GFW replies DNS queries of blocked sites with
+// bogus addresses. Connecting to these addresses may succeed, and the site
+// only shows up as blocked upon read timeout. COW checks the resolved
+// address of a direct connection against a list of known bogus IP before
+// connecting, so blocked site is detected without waiting for timeout.
+//
+// If trustedDNS is specified, address of a direct connection is also
+// compared in background with the answer from the trusted DNS server, which
+// is queried using TCP through parent proxy. Each host is checked at most
+// once in trustedDNSCheckInterval. As sites using CDN or geo DNS get
+// different answers in different places, address in the same network as the
+// trusted answer is considered fine. Other mismatch causes the host to be
+// checked again on next direct connection, and is considered as poisoning
+// only if it repeats trustedDNSMismatchCnt times in a row.
+//
+// The host is marked as blocked in site stat when poisoning is detected.
+
+var errDNSPoisoned = errors.New("DNS poisoned, resolved to bogus IP")
+
+// Addresses returned by GFW for blocked sites.
+var builtinBogusIP = []string{
+	"4.36.66.178", "8.7.198.45", "37.61.54.158", "46.82.174.68",
+	"59.24.3.173", "64.33.88.161", "64.33.99.47", "64.66.163.251",
+	"65.104.202.252", "65.160.219.113", "66.45.252.237", "72.14.205.99",
+	"72.14.205.104", "78.16.49.15", "93.46.8.89", "128.121.126.139",
+	"159.106.121.75", "169.132.13.103", "192.67.198.6", "202.106.1.2",
+	"202.181.7.85", "203.98.7.65", "203.161.230.171", "207.12.88.98",
+	"208.56.31.43", "209.36.73.33", "209.145.54.50", "209.220.30.174",
+	"211.94.66.147", "213.169.251.35", "216.221.188.182", "216.234.179.13",
+	"243.185.187.39",
+}
+
+var bogusIP struct {
+	ip  map[string]bool
+	net []*net.IPNet
+}
+
+func init() {
+	bogusIP.ip = make(map[string]bool)
+	for _, s := range builtinBogusIP {
+		bogusIP.ip[s] = true
+	}
+}
+
+// addBogusIP adds IP address or CIDR network to the bogus IP list.
+func addBogusIP(s string) error {
+	if strings.IndexByte(s, '/') != -1 {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		bogusIP.net = append(bogusIP.net, ipnet)
+		return nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return errors.New("invalid IP address " + s)
+	}
+	bogusIP.ip[ip.String()] = true
+	return nil
+}
+
+func isBogusIP(ip net.IP) bool {
+	if bogusIP.ip[ip.String()] {
+		return true
+	}
+	for _, n := range bogusIP.net {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(c net.Conn) net.IP {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// markDNSPoisoned marks the host as blocked. Blocked visit is counted when
+// the request is served by parent proxy.
+func markDNSPoisoned(url *URL, siteInfo *VisitCnt) {
+	if siteInfo.userSpecified() {
+		return
+	}
+	siteStat.TempBlocked(url)
+}
+
+// isDialErrBlocked returns true if the error in creating direct connection
+// is probably caused by GFW.
+func isDialErrBlocked(err error) bool {
+	return err == errDNSPoisoned || isDNSError(err) || maybeBlocked(err)
+}
+
+const (
+	trustedDNSCheckInterval = time.Hour
+	trustedDNSMismatchCnt   = 2
+)
+
+var trustedDNSChecked = struct {
+	sync.Mutex
+	m        map[string]time.Time // host -> check time
+	mismatch map[string]int       // host -> consecutive mismatch count
+}{m: make(map[string]time.Time), mismatch: make(map[string]int)}
+
+// shouldCheckTrustedDNS returns true if host is not checked recently.
+func shouldCheckTrustedDNS(host string) bool {
+	trustedDNSChecked.Lock()
+	defer trustedDNSChecked.Unlock()
+	now := time.Now()
+	if t, ok := trustedDNSChecked.m[host]; ok && now.Sub(t) < trustedDNSCheckInterval {
+		return false
+	}
+	if len(trustedDNSChecked.m) > 1024 {
+		trustedDNSChecked.m = make(map[string]time.Time)
+		trustedDNSChecked.mismatch = make(map[string]int)
+	}
+	trustedDNSChecked.m[host] = now
+	return true
+}
+
+// inSameNetwork returns true if ip is in the same /16 (IPv4) or /32 (IPv6)
+// network as any of ips.
+func inSameNetwork(ip net.IP, ips []net.IP) bool {
+	mask := net.CIDRMask(32, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(16, 32)
+	}
+	for _, tip := range ips {
+		if t4 := tip.To4(); t4 != nil {
+			tip = t4
+		}
+		if len(tip) == len(ip) && tip.Mask(mask).Equal(ip.Mask(mask)) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedDNSPoisoned returns true if ip, which host resolves to, is
+// considered as poisoned compared with answer from trusted DNS.
+func trustedDNSPoisoned(host string, ip net.IP, trusted []net.IP) bool {
+	if isBogusIP(ip) {
+		return true
+	}
+	trustedDNSChecked.Lock()
+	defer trustedDNSChecked.Unlock()
+	if inSameNetwork(ip, trusted) {
+		delete(trustedDNSChecked.mismatch, host)
+		return false
+	}
+	cnt := trustedDNSChecked.mismatch[host] + 1
+	if cnt >= trustedDNSMismatchCnt {
+		delete(trustedDNSChecked.mismatch, host)
+		return true
+	}
+	trustedDNSChecked.mismatch[host] = cnt
+	// check again on next direct connection
+	delete(trustedDNSChecked.m, host)
+	debug.Printf("%s resolved to %s, trusted DNS answer %v, check again later\n", host, ip, trusted)
+	return false
+}
+
+// checkTrustedDNS compares ip, which a direct connection to url connects
+// to, with the answer from trusted DNS server.
+func checkTrustedDNS(url *URL, siteInfo *VisitCnt, ip net.IP) {
+	qtype := dnsTypeA
+	if ip.To4() == nil {
+		qtype = dnsTypeAAAA
+	}
+	ips, err := queryTrustedDNS(url.Host, qtype)
+	if err != nil {
+		debug.Printf("query trusted DNS for %s: %v\n", url.Host, err)
+		return
+	}
+	if len(ips) == 0 || !trustedDNSPoisoned(url.Host, ip, ips) {
+		return
+	}
+	info.Printf("DNS poisoned? %s resolved to %s, trusted DNS answer %v\n", url.Host, ip, ips)
+	// The direct connection is in use, so count the blocked visit here.
+	markDNSPoisoned(url, siteInfo)
+	siteInfo.BlockedVisit()
+}
+
+func queryTrustedDNS(host string, qtype uint16) (ips []net.IP, err error) {
+	h, port := splitHostPort(config.TrustedDNS)
+	url := &URL{HostPort: config.TrustedDNS, Host: h, Port: port}
+	cn, err := createParentProxyConnection(url)
+	if err != nil {
+		return
+	}
+	defer cn.Close()
+	cn.SetDeadline(time.Now().Add(dialTimeout.get() + readTimeout.get()))
+
+	if hc, ok := cn.Conn.(httpConn); ok {
+		if err = httpParentConnect(hc, config.TrustedDNS); err != nil {
+			return
+		}
+	}
+	id := uint16(rand.Intn(0x10000))
+	msg, err := dnsTCPExchange(cn, dnsTCPQuery(id, host, qtype))
+	if err != nil {
+		return
+	}
+	ips, _, err = parseDNSAnswer(msg, id, qtype)
+	return
+}
+
+// httpParentConnect creates tunnel to hostPort through http parent proxy.
+func httpParentConnect(hc httpConn, hostPort string) (err error) {
+	req := []byte("CONNECT " + hostPort + " HTTP/1.1\r\nHost: " + hostPort + "\r\n")
+	req = append(req, hc.parent.authHeader...)
+	req = append(req, CRLF...)
+	if _, err = hc.Write(req); err != nil {
+		return
+	}
+	// Read byte by byte to avoid consuming data after the response.
+	var rep []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(rep, []byte("\r\n\r\n")) {
+		if len(rep) > 4096 {
+			return errMalformResponse
+		}
+		if _, err = hc.Read(b); err != nil {
+			return
+		}
+		rep = append(rep, b[0])
+	}
+	if f := bytes.Fields(rep); len(f) < 2 || string(f[1]) != "200" {
+		return errors.New("http parent CONNECT failed: " + string(bytes.SplitN(rep, []byte(CRLF), 2)[0]))
+	}
+	return nil
+}
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsClassIN         = 1
+)
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+const dnsRcodeNXDomain = 3
+
+type dnsRcodeError int
+
+func (e dnsRcodeError) Error() string {
+	if e == dnsRcodeNXDomain {
+		return "no such host"
+	}
+	return "DNS error rcode " + strconv.Itoa(int(e))
+}
+
+// dnsTCPQuery creates a DNS query message with 2 bytes length prefix for
+// TCP.
+func dnsTCPQuery(id uint16, host string, qtype uint16) []byte {
+	b := make([]byte, 2, 2+12+len(host)+6)
+	// header: id, recursion desired, 1 question
+	b = append(b, byte(id>>8), byte(id), 1, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+	return b
+}
+
+// dnsTCPExchange sends query with length prefix and returns the response
+// message without length prefix.
+func dnsTCPExchange(rw io.ReadWriter, query []byte) (msg []byte, err error) {
+	if _, err = rw.Write(query); err != nil {
+		return
+	}
+	var lenBuf [2]byte
+	if _, err = io.ReadFull(rw, lenBuf[:]); err != nil {
+		return
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err = io.ReadFull(rw, msg); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// skipDNSName returns the offset after the domain name starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0: // compression pointer
+			return off + 2, nil
+		}
+		off += 1 + l
+	}
+	return 0, errDNSMessage
+}
+
+// parseDNSAnswer returns addresses of qtype in the answer section. ttl is
+// the minimum TTL of all answer records.
+func parseDNSAnswer(msg []byte, id uint16, qtype uint16) (ips []net.IP, ttl uint32, err error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return nil, 0, errDNSMessage
+	}
+	if rcode := msg[3] & 0xf; rcode != 0 {
+		return nil, 0, dnsRcodeError(rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return
+		}
+		off += 4 // type, class
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		if t := binary.BigEndian.Uint32(msg[off+4:]); i == 0 || t < ttl {
+			ttl = t
+		}
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		if typ == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte(nil), msg[off:off+rdlen]...)))
+		}
+		off += rdlen
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestIsBogusIP(t *testing.T) {
+	if err := addBogusIP("10.10.10.10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addBogusIP("2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addBogusIP("1.2.3"); err == nil {
+		t.Error("invalid IP should return error")
+	}
+	defer func() {
+		delete(bogusIP.ip, "10.10.10.10")
+		bogusIP.net = nil
+	}()
+
+	var testData = []struct {
+		ip    string
+		bogus bool
+	}{
+		{"93.46.8.89", true},
+		{"10.10.10.10", true},
+		{"2001:db8::1", true},
+		{"8.8.8.8", false},
+		{"2001:db9::1", false},
+	}
+	for _, td := range testData {
+		if isBogusIP(net.ParseIP(td.ip)) != td.bogus {
+			t.Errorf("%s should be bogus %v\n", td.ip, td.bogus)
+		}
+	}
+}
+
+func TestDNSTCPQuery(t *testing.T) {
+	q := dnsTCPQuery(0x1234, "www.g.com", dnsTypeA)
+	want := []byte{0, 27, 0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		3, 'w', 'w', 'w', 1, 'g', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	if !bytes.Equal(q, want) {
+		t.Errorf("DNS query %v\nwant %v\n", q, want)
+	}
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	msg := dnsTCPQuery(0x1234, "www.g.com", dnsTypeA)[2:]
+	msg[2], msg[3] = 0x81, 0x80 // response, recursion available
+	msg[7] = 3                  // 3 answers
+	msg = append(msg,
+		// CNAME pointing to g.com, name is pointer to question
+		0xc0, 12, 0, 5, 0, 1, 0, 0, 0, 60, 0, 2, 0xc0, 16,
+		// A records for g.com
+		0xc0, 16, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 1, 2, 3, 4,
+		0xc0, 16, 0, 1, 0, 1, 0, 0, 0, 30, 0, 4, 5, 6, 7, 8)
+
+	ips, ttl, err := parseDNSAnswer(msg, 0x1234, dnsTypeA)
+	if err != nil {
+		t.Fatal("parse DNS answer:", err)
+	}
+	if ttl != 30 {
+		t.Error("DNS answer ttl should be minimum 30, got", ttl)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("1.2.3.4")) || !ips[1].Equal(net.ParseIP("5.6.7.8")) {
+		t.Error("DNS answer parse error, got", ips)
+	}
+
+	if _, _, err = parseDNSAnswer(msg, 0x4321, dnsTypeA); err == nil {
+		t.Error("should return error for mismatched id")
+	}
+	if _, _, err = parseDNSAnswer(msg[:len(msg)-2], 0x1234, dnsTypeA); err == nil {
+		t.Error("should return error for truncated message")
+	}
+	msg[3] = 0x83 // NXDOMAIN
+	if _, _, err = parseDNSAnswer(msg, 0x1234, dnsTypeA); err != dnsRcodeError(dnsRcodeNXDomain) {
+		t.Error("should return NXDOMAIN error, got", err)
+	}
+}
+
+func TestTrustedDNSPoisoned(t *testing.T) {
+	trusted := []net.IP{net.ParseIP("104.16.1.1"), net.ParseIP("2606:4700::1")}
+	var testData = []struct {
+		host     string
+		ip       string
+		poisoned bool
+	}{
+		{"bogus.example.com", "93.46.8.89", true},
+		{"cdn.example.com", "104.16.200.3", false},
+		{"cdn.example.com", "2606:4700:10::6", false},
+		// single mismatch is not considered as poisoned
+		{"a.example.com", "31.13.64.1", false},
+		{"a.example.com", "31.13.64.1", true},
+		// match resets mismatch count
+		{"b.example.com", "31.13.64.1", false},
+		{"b.example.com", "104.16.0.1", false},
+		{"b.example.com", "31.13.64.1", false},
+	}
+	for i, td := range testData {
+		if trustedDNSPoisoned(td.host, net.ParseIP(td.ip), trusted) != td.poisoned {
+			t.Errorf("%d: %s resolved to %s should be poisoned %v\n", i, td.host, td.ip, td.poisoned)
+		}
+	}
+}
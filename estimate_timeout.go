@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,8 +12,20 @@ const minReadTimeout = 4 * time.Second
 const defaultDialTimeout = 5 * time.Second
 const defaultReadTimeout = 5 * time.Second
 
-var dialTimeout = defaultDialTimeout
-var readTimeout = defaultReadTimeout
+// atomicDuration is used for timeout adjusted by estimateTimeout and reload
+// while being read by connections.
+type atomicDuration int64
+
+func (d *atomicDuration) get() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(d)))
+}
+
+func (d *atomicDuration) set(v time.Duration) {
+	atomic.StoreInt64((*int64)(d), int64(v))
+}
+
+var dialTimeout = atomicDuration(defaultDialTimeout)
+var readTimeout = atomicDuration(defaultReadTimeout)
 
 // use a fast to fetch web site
 const estimateSite = "www.baidu.com"
@@ -33,6 +46,7 @@ func estimateTimeout() {
 	buf := connectBuf.Get()
 	defer connectBuf.Put(buf)
 	var est time.Duration
+	var rc *reloadableConfig
 
 	start := time.Now()
 	c, err := net.Dial("tcp", estimateSite+":80")
@@ -43,14 +57,15 @@ func estimateTimeout() {
 	}
 	defer c.Close()
 
+	rc = rconfig()
 	est = time.Now().Sub(start) * 5
 	debug.Println("estimated dialTimeout:", est)
-	if est > config.DialTimeout {
-		dialTimeout = est
-		info.Println("new dial timeout:", dialTimeout)
-	} else if dialTimeout != config.DialTimeout {
-		dialTimeout = config.DialTimeout
-		info.Println("new dial timeout:", dialTimeout)
+	if est > rc.DialTimeout {
+		dialTimeout.set(est)
+		info.Println("new dial timeout:", est)
+	} else if dialTimeout.get() != rc.DialTimeout {
+		dialTimeout.set(rc.DialTimeout)
+		info.Println("new dial timeout:", rc.DialTimeout)
 	}
 
 	start = time.Now()
@@ -68,24 +83,26 @@ func estimateTimeout() {
 			estimateSite, err)
 		goto onErr
 	}
+	rc = rconfig()
 	est = time.Now().Sub(start) * 10
 	debug.Println("estimated read timeout:", est)
-	if est > time.Duration(config.ReadTimeout) {
-		readTimeout = est
-		info.Println("new read timeout:", readTimeout)
-	} else if readTimeout != config.ReadTimeout {
-		readTimeout = config.ReadTimeout
-		info.Println("new read timeout:", readTimeout)
+	if est > rc.ReadTimeout {
+		readTimeout.set(est)
+		info.Println("new read timeout:", est)
+	} else if readTimeout.get() != rc.ReadTimeout {
+		readTimeout.set(rc.ReadTimeout)
+		info.Println("new read timeout:", rc.ReadTimeout)
 	}
 	return
 onErr:
-	dialTimeout += 2
-	readTimeout += 2
+	dialTimeout.set(dialTimeout.get() + 2)
+	readTimeout.set(readTimeout.get() + 2)
 }
 
 func runEstimateTimeout() {
-	readTimeout = config.ReadTimeout
-	dialTimeout = config.DialTimeout
+	rc := rconfig()
+	readTimeout.set(rc.ReadTimeout)
+	dialTimeout.set(rc.DialTimeout)
 	for {
 		estimateTimeout()
 		time.Sleep(30 * time.Second)
@@ -94,6 +111,7 @@ func runEstimateTimeout() {
 
 // Guess network status based on doing HTTP request to estimateSite
 func networkBad() bool {
-	return (readTimeout != config.ReadTimeout) ||
-		(dialTimeout != config.DialTimeout)
+	rc := rconfig()
+	return (readTimeout.get() != rc.ReadTimeout) ||
+		(dialTimeout.get() != rc.DialTimeout)
 }
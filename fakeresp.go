@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Some networks don't reset connection for blocked sites, but inject
+// redirect or block page. Responses matching fake response fingerprint on
+// direct connection are taken as blocked, and the request is retried with
+// parent proxy.
+//
+// A fingerprint contains space separated conditions, all of them must match:
+//
+//	status:302           status code
+//	location:http://x/   prefix of Location header
+//	header:X-Foo         header exists, "header:X-Foo:bar" also checks value prefix
+//	size:1234            Content-Length
+//	md5:<hex>            MD5 of response body, requires Content-Length not
+//	                     larger than fakeRespMaxBody
+
+const fakeRespMaxBody = 4096
+
+var errFakeResponse = errors.New("injected fake response")
+
+type headerMarker struct {
+	name  string // lower case
+	value string // prefix of value, empty matches any value
+}
+
+type fakeResponse struct {
+	spec     string
+	status   int
+	location string
+	header   []headerMarker
+	size     int64 // -1 if not specified
+	md5      []byte
+}
+
+// Parsed from config file upon start up. Use rconfig().fakeResponses which
+// is updated upon reload.
+var fakeResponses []*fakeResponse
+
+func parseFakeResponse(spec string) (*fakeResponse, error) {
+	fr := &fakeResponse{spec: spec, size: -1}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("empty fake response fingerprint")
+	}
+	for _, f := range fields {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.New("invalid fake response condition " + f)
+		}
+		var err error
+		switch val := kv[1]; strings.ToLower(kv[0]) {
+		case "status":
+			fr.status, err = strconv.Atoi(val)
+		case "location":
+			fr.location = val
+		case "header":
+			hv := strings.SplitN(val, ":", 2)
+			hm := headerMarker{name: strings.ToLower(hv[0])}
+			if len(hv) == 2 {
+				hm.value = hv[1]
+			}
+			fr.header = append(fr.header, hm)
+		case "size":
+			fr.size, err = strconv.ParseInt(val, 10, 64)
+		case "md5":
+			if fr.md5, err = hex.DecodeString(val); err == nil && len(fr.md5) != md5.Size {
+				err = errors.New("invalid md5 " + val)
+			}
+		default:
+			err = errors.New("unknown fake response condition " + kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fr, nil
+}
+
+// responseHeader returns value of header name (lower case) in raw response
+// header.
+func responseHeader(raw []byte, name string) (val string, ok bool) {
+	lines := bytes.Split(raw, []byte("\n"))
+	for _, line := range lines[1:] {
+		f := bytes.SplitN(line, []byte{':'}, 2)
+		if len(f) == 2 && string(ASCIIToLower(TrimSpace(f[0]))) == name {
+			return string(TrimSpace(f[1])), true
+		}
+	}
+	return "", false
+}
+
+// match checks the response against fingerprint. body is nil if not
+// available.
+func (fr *fakeResponse) match(rp *Response, body []byte) bool {
+	if fr.status != 0 && fr.status != rp.Status {
+		return false
+	}
+	if fr.size != -1 && fr.size != rp.ContLen {
+		return false
+	}
+	raw := rp.rawResponse()
+	if fr.location != "" {
+		if loc, ok := responseHeader(raw, "location"); !ok || !strings.HasPrefix(loc, fr.location) {
+			return false
+		}
+	}
+	for _, hm := range fr.header {
+		if val, ok := responseHeader(raw, hm.name); !ok || !strings.HasPrefix(val, hm.value) {
+			return false
+		}
+	}
+	if fr.md5 != nil {
+		if body == nil {
+			return false
+		}
+		sum := md5.Sum(body)
+		return bytes.Equal(sum[:], fr.md5)
+	}
+	return true
+}
+
+// isFakeResponse checks the response header read from sv against all
+// fingerprints in frs. Response body is peeked only if needed.
+func (sv *serverConn) isFakeResponse(r *Request, rp *Response, frs []*fakeResponse) bool {
+	var body []byte
+	bodyRead := false
+	for _, fr := range frs {
+		if fr.md5 != nil && !bodyRead {
+			bodyRead = true
+			if rp.ContLen >= 0 && rp.ContLen <= fakeRespMaxBody && rp.hasBody(r.Method) {
+				body, _ = sv.bufRd.Peek(int(rp.ContLen))
+			}
+		}
+		if fr.match(rp, body) {
+			info.Printf("%s response %s matches fake response fingerprint \"%s\"\n", r, rp, fr.spec)
+			return true
+		}
+	}
+	return false
+}
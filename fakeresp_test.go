@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseFakeResponse(t *testing.T) {
+	fr, err := parseFakeResponse("status:302 location:http://warning.or.kr header:Server:nginx size:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.status != 302 || fr.location != "http://warning.or.kr" || fr.size != 0 ||
+		len(fr.header) != 1 || fr.header[0] != (headerMarker{"server", "nginx"}) {
+		t.Errorf("fake response parse error: %+v\n", fr)
+	}
+
+	for _, s := range []string{"", "status:abc", "size:", "md5:1234", "foo:bar", "status"} {
+		if _, err := parseFakeResponse(s); err == nil {
+			t.Errorf("%q should return error\n", s)
+		}
+	}
+}
+
+func TestFakeResponseMatch(t *testing.T) {
+	var rp Response
+	rp.reset()
+	defer rp.releaseBuf()
+	rp.Status = 302
+	rp.ContLen = 5
+	rp.raw.WriteString("HTTP/1.1 302 Found\r\nLocation: http://warning.or.kr/i1.html\r\n" +
+		"X-Block: yes\r\nContent-Length: 5\r\n\r\n")
+	body := []byte("block")
+	sum := md5.Sum(body)
+	bodyMD5 := hex.EncodeToString(sum[:])
+
+	var testData = []struct {
+		spec  string
+		match bool
+	}{
+		{"status:302", true},
+		{"status:403", false},
+		{"location:http://warning.or.kr", true},
+		{"status:302 location:http://www.warning.or.kr", false},
+		{"header:x-block", true},
+		{"header:X-Block:yes", true},
+		{"header:X-Block:no", false},
+		{"header:Server", false},
+		{"size:5", true},
+		{"size:6", false},
+		{"status:302 md5:" + bodyMD5, true},
+		{"md5:00000000000000000000000000000000", false},
+	}
+	for _, td := range testData {
+		fr, err := parseFakeResponse(td.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.match(&rp, body) != td.match {
+			t.Errorf("%q should match %v\n", td.spec, td.match)
+		}
+	}
+
+	fr, _ := parseFakeResponse("md5:" + bodyMD5)
+	if fr.match(&rp, nil) {
+		t.Error("md5 should not match without body")
+	}
+}
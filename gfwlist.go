@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// Import GFWList, which uses base64 encoded AdBlock Plus filter syntax.
+// Supported rules:
+//
+//	||example.com       example.com and all its sub domains
+//	|http://example.com URL starts with, converted to host rule
+//	@@||example.com     exception, taken as direct
+//	/regexp/            regular expression on URL
+//	example             keyword, matches host containing it
+//
+// Rules are applied to host. Rules with path are skipped, so a host is not
+// mistakenly taken as blocked or direct because of some of its pages.
+// Exceptions in all lists take precedence over blocking rules.
+
+var (
+	errNoHostInRule = errors.New("no host in rule")
+	errRuleWithPath = errors.New("rule with path not supported")
+)
+
+// loadGFWLists returns imported rules with exceptions coming first.
+func loadGFWLists(files []string) []*siteRule {
+	var exceptions, blocking []*siteRule
+	for _, fpath := range files {
+		rules, err := loadGFWList(fpath)
+		if err != nil {
+			errl.Printf("Error loading GFWList %s: %v\n", fpath, err)
+			continue
+		}
+		for _, r := range rules {
+			if r.blocked {
+				blocking = append(blocking, r)
+			} else {
+				exceptions = append(exceptions, r)
+			}
+		}
+		debug.Printf("loaded %d rules from GFWList %s\n", len(rules), fpath)
+	}
+	return append(exceptions, blocking...)
+}
+
+func loadGFWList(fpath string) (rules []*siteRule, err error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(decodeGFWList(b)), "\n") {
+		r, err := parseAdBlockRule(strings.TrimSpace(line))
+		if err != nil {
+			debug.Printf("GFWList %s rule %s: %v\n", fpath, line, err)
+			continue
+		}
+		if r != nil {
+			r.source = fpath
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// decodeGFWList decodes base64 content, plain text list is returned as is.
+func decodeGFWList(b []byte) []byte {
+	dec, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(b), nil)))
+	if err != nil {
+		return b
+	}
+	return dec
+}
+
+// parseAdBlockRule returns nil rule for comment and unsupported rule.
+func parseAdBlockRule(line string) (*siteRule, error) {
+	if line == "" || line[0] == '!' || line[0] == '[' || strings.Contains(line, "##") {
+		return nil, nil
+	}
+	r := &siteRule{pattern: line, blocked: true}
+	if strings.HasPrefix(line, "@@") {
+		r.blocked = false
+		line = line[2:]
+	}
+	if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		re, err := regexp.Compile(line[1 : len(line)-1])
+		if err != nil {
+			return nil, err
+		}
+		r.re, r.url = re, true
+		return r, nil
+	}
+	if i := strings.IndexByte(line, '$'); i != -1 {
+		line = line[:i] // filter options
+	}
+	if line == "" {
+		return nil, nil // only exception mark or options
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(line, "||"):
+		host, hasPath := adBlockHost(line[2:])
+		if strings.ContainsAny(host, "*?") {
+			r.re, err = regexp.Compile(`^(.*\.)?` + wildcard2Regexp(host)[1:])
+		} else {
+			r.suffix = host
+		}
+		err = checkAdBlockHost(r, host, hasPath, err)
+	case line[0] == '|':
+		line = line[1:]
+		if i := strings.Index(line, "://"); i != -1 {
+			line = line[i+3:]
+		}
+		host, hasPath := adBlockHost(line)
+		if strings.ContainsAny(host, "*?") {
+			r.re, err = regexp.Compile(wildcard2Regexp(host))
+		} else {
+			r.host = host
+		}
+		err = checkAdBlockHost(r, host, hasPath, err)
+	default:
+		host, hasPath := adBlockHost(line)
+		parts := strings.Split(host, "*")
+		for i, p := range parts {
+			parts[i] = regexp.QuoteMeta(p)
+		}
+		r.re, err = regexp.Compile(strings.Join(parts, ".*"))
+		err = checkAdBlockHost(r, host, hasPath, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func checkAdBlockHost(r *siteRule, host string, hasPath bool, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case strings.Trim(host, "*.") == "":
+		return errNoHostInRule
+	case hasPath:
+		return errRuleWithPath
+	}
+	return nil
+}
+
+// adBlockHost returns the host part in rule, hasPath is true if there's
+// anything other than host and root path.
+func adBlockHost(s string) (host string, hasPath bool) {
+	host = s
+	if i := strings.IndexAny(s, "/^:?"); i != -1 {
+		host = s[:i]
+		rest := strings.TrimLeft(s[i:], "/^")
+		hasPath = rest != "" && rest != "*"
+	}
+	return strings.ToLower(host), hasPath
+}
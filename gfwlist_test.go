@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAdBlockRule(t *testing.T) {
+	var testData = []struct {
+		rule    string
+		host    string
+		match   bool
+		blocked bool
+	}{
+		{"||google.com", "www.google.com", true, true},
+		{"||google.com", "google.com", true, true},
+		{"||google.com", "notgoogle.com", false, true},
+		{"||*.blogspot.com", "a.b.blogspot.com", true, true},
+		{"|http://www.example.com/", "www.example.com", true, true},
+		{"|http://www.example.com", "example.com", false, true},
+		{"|https://*.example.org", "img.example.org", true, true},
+		{"@@||cn.example.com", "www.cn.example.com", true, false},
+		{"@@|http://ok.example.com/", "ok.example.com", true, false},
+		{`/^https?:\/\/[^\/]+blogspot\.(.*)/`, "x.blogspot.jp", true, true},
+		{`/^https?:\/\/[^\/]+blogspot\.(.*)/`, "blogspot.jp", false, true},
+		{"twitter", "mobile.twitter.com", true, true},
+		{"*.wikipedia.org/*", "zh.wikipedia.org", true, true},
+		{"||example.net^$third-party", "www.example.net", true, true},
+	}
+	for _, td := range testData {
+		r, err := parseAdBlockRule(td.rule)
+		if err != nil || r == nil {
+			t.Fatalf("%s should be valid rule, err: %v\n", td.rule, err)
+		}
+		if r.blocked != td.blocked {
+			t.Errorf("%s blocked should be %v\n", td.rule, td.blocked)
+		}
+		if r.match(td.host, nil) != td.match {
+			t.Errorf("%s match %s should be %v\n", td.rule, td.host, td.match)
+		}
+	}
+
+	for _, s := range []string{"", "! comment", "[AutoProxy 0.2.9]", "example.com##.ad",
+		"@@", "$third-party", "@@$domain=a.com"} {
+		if r, err := parseAdBlockRule(s); r != nil || err != nil {
+			t.Errorf("%q should be ignored, got %v %v\n", s, r, err)
+		}
+	}
+	for _, s := range []string{"@@|http://example.com/page", "|http://www.example.com/page.html",
+		"||example.com/search", "*.wikipedia.org/wiki/*", "/a(b/", "||*"} {
+		if _, err := parseAdBlockRule(s); err == nil {
+			t.Errorf("%q should return error\n", s)
+		}
+	}
+}
+
+func TestLoadGFWLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-gfwlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "[AutoProxy 0.2.9]\n! comment\n||google.com\n@@||ok.google.com\n"
+	enc := base64.StdEncoding.EncodeToString([]byte(content))
+	// base64 content is usually wrapped
+	f1 := filepath.Join(dir, "gfwlist.txt")
+	if err := ioutil.WriteFile(f1, []byte(enc[:20]+"\n"+enc[20:]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f2 := filepath.Join(dir, "plain.txt")
+	if err := ioutil.WriteFile(f2, []byte("||twitter.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := loadGFWLists([]string{f1, f2, filepath.Join(dir, "nosuchfile")})
+	if len(rules) != 3 {
+		t.Fatal("should load 3 rules, got", len(rules))
+	}
+	if rules[0].blocked || rules[0].source != f1 {
+		t.Errorf("exception should come first, got %+v\n", rules[0])
+	}
+	if r := matchSiteRule(rules, "www.ok.google.com"); r == nil || r.blocked {
+		t.Error("exception should override blocking rule")
+	}
+	if r := matchSiteRule(rules, "www.twitter.com"); r == nil || !r.blocked || r.source != f2 {
+		t.Error("plain text list should be loaded")
+	}
+}
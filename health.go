@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Health checking of parent proxies, disabled unless healthCheckInterval is
+// set. A background goroutine connects to config.HealthCheckTarget through
+// every parent proxy and sends a simple HTTP request. Parents failing the
+// check are marked down and skipped when creating connections, so clients
+// don't have to wait for a dead parent to time out. Down parents are checked
+// more frequently, and are marked up again as soon as a check succeeds.
+//
+// Client requests are not used as probes: connection errors on them are only
+// counted for the stat page, and never mark a parent down. Without health
+// check, every parent is tried in order for each request.
+
+const (
+	defaultHealthCheckTarget = "www.google.com:80"
+	healthRecheckInterval    = 10 * time.Second // for checking down parents
+)
+
+type parentHealth struct {
+	down      bool
+	failCnt   int // consecutive connection errors
+	lastCheck time.Time
+	lastErr   error // error of last health check
+}
+
+var (
+	errHealthCheckResponse = errors.New("health check: not HTTP response")
+	errHealthCheckTimeout  = errors.New("health check: timeout")
+)
+
+func parentProxyUp(i int) bool {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return !st.health.down
+}
+
+// parentProxyUpCnt returns the number of parent proxies considered up.
+func parentProxyUpCnt() (cnt int) {
+	for i := range parentProxy {
+		if parentProxyUp(i) {
+			cnt++
+		}
+	}
+	return
+}
+
+// parentProxySucceeded is called when a connection through parent proxy i
+// is created.
+func parentProxySucceeded(i int) {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	if st.health.down {
+		info.Println("parent proxy up:", parentProxy[i].Name())
+	}
+	st.health.down = false
+	st.health.failCnt = 0
+	st.mu.Unlock()
+}
+
+// parentProxyFailed is called when a connection through parent proxy i
+// fails. Only health check marks a parent down.
+func parentProxyFailed(i int) {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	st.health.failCnt++
+	st.mu.Unlock()
+}
+
+func setParentProxyHealth(i int, err error) {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	st.health.lastCheck = time.Now()
+	st.health.lastErr = err
+	st.mu.Unlock()
+
+	if err == nil {
+		parentProxySucceeded(i)
+		return
+	}
+	if networkBad() {
+		return
+	}
+	st.mu.Lock()
+	if !st.health.down {
+		st.health.down = true
+		info.Printf("parent proxy down: %s %v\n", parentProxy[i].Name(), err)
+	}
+	st.mu.Unlock()
+}
+
+func genHealthCheckRequest(hostPort string, ct connType) []byte {
+	uri := "/"
+	if ct == ctHttpProxyConn {
+		uri = "http://" + hostPort + "/"
+	}
+	return []byte("HEAD " + uri + " HTTP/1.1\r\nHost: " + hostPort +
+		"\r\nConnection: close\r\n\r\n")
+}
+
+// checkParentProxy connects to health check target through parent proxy i,
+// sends a HEAD request and checks whether the response looks like HTTP.
+//
+// Deadline has no effect on some connections (e.g. ssh channel), so the check
+// is run in its own goroutine and the connection is closed on timeout, which
+// unblocks the check.
+func checkParentProxy(i int, url *URL) error {
+	cnCh := make(chan conn, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- probeParentProxy(i, url, cnCh)
+	}()
+
+	timer := time.NewTimer(dialTimeout.get() + readTimeout.get())
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+	}
+	go func() {
+		// Dial may still be in progress, close the connection once created.
+		select {
+		case cn := <-cnCh:
+			cn.Close()
+		case <-errCh:
+		}
+	}()
+	return errHealthCheckTimeout
+}
+
+// probeParentProxy does the health check. Connection is sent to cnCh once
+// created.
+func probeParentProxy(i int, url *URL, cnCh chan<- conn) (err error) {
+	start := time.Now()
+	cn, err := parentProxy[i].Dial(url)
+	if err != nil {
+		return
+	}
+	updateLatency(i, time.Now().Sub(start))
+	cnCh <- cn
+	defer cn.Close()
+
+	cn.SetDeadline(time.Now().Add(dialTimeout.get() + readTimeout.get()))
+	req := genHealthCheckRequest(url.HostPort, cn.connType)
+	if hc, ok := cn.Conn.(httpConn); ok && hc.parent.authHeader != nil {
+		req = append(req[:len(req)-len(CRLF)], hc.parent.authHeader...)
+		req = append(req, CRLF...)
+	}
+	if _, err = cn.Write(req); err != nil {
+		return
+	}
+	buf := make([]byte, len("HTTP/"))
+	if _, err = io.ReadFull(cn, buf); err != nil {
+		return
+	}
+	if !bytes.Equal(buf, []byte("HTTP/")) {
+		return errHealthCheckResponse
+	}
+	return nil
+}
+
+// checkAllParentProxy checks all parent proxies concurrently. If onlyDown is
+// true, only parents marked down are checked.
+func checkAllParentProxy(url *URL, onlyDown bool) {
+	var wg sync.WaitGroup
+	for i := range parentProxy {
+		if onlyDown && parentProxyUp(i) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			err := checkParentProxy(i, url)
+			if err != nil {
+				debug.Printf("health check parent proxy %s: %v\n", parentProxy[i].Name(), err)
+			}
+			setParentProxyHealth(i, err)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func runHealthCheck() {
+	if len(parentProxy) == 0 || config.HealthCheckInterval == 0 {
+		return
+	}
+	url, err := ParseRequestURI(config.HealthCheckTarget)
+	if err != nil {
+		errl.Println("health check target:", err)
+		return
+	}
+
+	recheck := healthRecheckInterval
+	if recheck > config.HealthCheckInterval {
+		recheck = config.HealthCheckInterval
+	}
+	last := time.Time{}
+	for {
+		if time.Now().Sub(last) >= config.HealthCheckInterval {
+			checkAllParentProxy(url, false)
+			last = time.Now()
+		} else if parentProxyUpCnt() != len(parentProxy) {
+			checkAllParentProxy(url, true)
+		}
+		time.Sleep(recheck)
+	}
+}
+
+func parentProxyHealthString(i int) string {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := "up"
+	if st.health.down {
+		s = "down"
+	}
+	return fmt.Sprintf("%-6s %8d", s, st.health.failCnt)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParentProxyFailed(t *testing.T) {
+	defer initTestParentProxy(nil)()
+
+	for i := 1; i <= 10; i++ {
+		parentProxyFailed(0)
+		if !parentProxyUp(0) {
+			t.Fatalf("parent should not be marked down by %d client errors\n", i)
+		}
+	}
+	if parentProxy[0].Stats().health.failCnt != 10 {
+		t.Error("client errors should be counted")
+	}
+	setParentProxyHealth(0, errHealthCheckResponse)
+	if parentProxyUp(0) {
+		t.Error("parent should be down after failed health check")
+	}
+	parentProxySucceeded(0)
+	if !parentProxyUp(0) || parentProxy[0].Stats().health.failCnt != 0 {
+		t.Error("parent should be up after success")
+	}
+}
+
+// healthTestServer accepts one connection, reads the request line and sends
+// back resp.
+func healthTestServer(t *testing.T, ln net.Listener, wantReqLine, resp string) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Error("health check server reading request:", err)
+		return
+	}
+	if strings.TrimSpace(line) != wantReqLine {
+		t.Errorf("health check request %q, want %q\n", line, wantReqLine)
+	}
+	c.Write([]byte(resp))
+}
+
+func TestCheckParentProxy(t *testing.T) {
+	var testData = []struct {
+		ct      connType
+		resp    string
+		reqLine string
+		healthy bool
+	}{
+		{ctSocksConn, "HTTP/1.1 200 OK\r\n\r\n", "HEAD / HTTP/1.1", true},
+		{ctHttpProxyConn, "HTTP/1.0 302 Found\r\n\r\n", "HEAD http://www.example.com:80/ HTTP/1.1", true},
+		{ctSocksConn, "SSH-2.0-OpenSSH\r\n", "HEAD / HTTP/1.1", false},
+		{ctSocksConn, "", "HEAD / HTTP/1.1", false},
+	}
+	defer initTestParentProxy(nil)()
+	tp := parentProxy[0].(*testParent)
+	url, _ := ParseRequestURI("www.example.com:80")
+
+	for _, td := range testData {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("listen:", err)
+		}
+		go healthTestServer(t, ln, td.reqLine, td.resp)
+		ct := td.ct
+		tp.dial = func(*URL) (conn, error) {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if ct == ctHttpProxyConn {
+				return conn{httpConn{c, &httpParent{}}, ct, nil}, err
+			}
+			return conn{c, ct, nil}, err
+		}
+
+		setParentProxyHealth(0, checkParentProxy(0, url))
+		if parentProxyUp(0) != td.healthy {
+			t.Errorf("%s parent response %q, health %v, want %v\n", ctName[td.ct], td.resp,
+				parentProxyUp(0), td.healthy)
+		}
+		ln.Close()
+	}
+}
+
+// noDeadlineConn ignores deadline, like ssh channel.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (noDeadlineConn) SetDeadline(time.Time) error { return nil }
+
+func TestCheckParentProxyTimeout(t *testing.T) {
+	defer initTestParentProxy(nil)()
+	oldDial, oldRead := dialTimeout.get(), readTimeout.get()
+	dialTimeout.set(50 * time.Millisecond)
+	readTimeout.set(50 * time.Millisecond)
+	defer func() {
+		dialTimeout.set(oldDial)
+		readTimeout.set(oldRead)
+	}()
+
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	closed := make(chan bool)
+	go func() {
+		// read request and never respond
+		buf := make([]byte, 512)
+		for {
+			if _, err := srv.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	tp := parentProxy[0].(*testParent)
+	tp.dial = func(*URL) (conn, error) {
+		return conn{noDeadlineConn{cli}, ctSocksConn, nil}, nil
+	}
+	url, _ := ParseRequestURI("www.example.com:80")
+
+	done := make(chan error)
+	go func() {
+		done <- checkParentProxy(0, url)
+	}()
+	select {
+	case err := <-done:
+		if err != errHealthCheckTimeout {
+			t.Error("hung health check should timeout, got:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hung health check not returned")
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("connection of hung health check not closed")
+	}
+}
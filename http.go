@@ -16,8 +16,10 @@ type Header struct {
 	ContLen             int64
 	KeepAlive           time.Duration
 	ProxyAuthorization  string
+	Upgrade             string
 	Chunking            bool
 	ConnectionKeepAlive bool
+	ConnectionUpgrade   bool
 }
 
 type rqState byte
@@ -46,6 +48,9 @@ type Request struct {
 	partial   bool // whether contains only partial request data
 	state     rqState
 	tryCnt    byte
+
+	tlsHello bool   // CONNECT tunnel starts with TLS ClientHello
+	sni      string // server name in ClientHello
 }
 
 var zeroRequest = Request{}
@@ -65,6 +70,23 @@ func (r *Request) reset() {
 	}
 }
 
+// initConnect makes r a CONNECT request to url. Used for clients that don't
+// send HTTP request to COW. The generated request is sent if using http
+// parent proxy.
+func (r *Request) initConnect(url *URL) {
+	r.reset()
+	r.Method = "CONNECT"
+	r.URL = url
+	r.isConnect = true
+
+	r.raw.WriteString("CONNECT " + url.HostPort + " HTTP/1.1\r\n")
+	r.reqLnStart = r.raw.Len()
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: " + url.HostPort + CRLF)
+	r.raw.WriteString(CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
 func (r *Request) String() (s string) {
 	return fmt.Sprintf("%s %s%s", r.Method, r.URL.HostPort, r.URL.Path)
 }
@@ -96,6 +118,14 @@ func (r *Request) responseNotSent() bool {
 	return r.state <= rsSent
 }
 
+// canPipeline returns true if the request can be sent before the response of
+// the previous request is received. Only idempotent requests without body
+// are pipelined, they can be safely sent again if the connection is closed.
+func (r *Request) canPipeline() bool {
+	return (r.Method == "GET" || r.Method == "HEAD") &&
+		!r.Chunking && r.ContLen <= 0 && r.Upgrade == ""
+}
+
 func (r *Request) releaseBuf() {
 	if r.raw != nil {
 		httpBuf.Put(r.rawByte)
@@ -199,11 +229,28 @@ func (url *URL) HostIsIP() bool {
 }
 
 // For port, return empty string if no port specified.
-// This also works for IPv6 address.
+// This also works for IPv6 address, brackets are removed from the returned
+// host.
 func splitHostPort(s string) (host, port string) {
 	if len(s) == 0 {
 		return "", ""
 	}
+	if s[0] == '[' {
+		// IPv6 address in brackets: [::1] or [::1]:80
+		id := strings.IndexByte(s, ']')
+		if id == -1 {
+			return s, ""
+		}
+		host = s[1:id]
+		if id+1 < len(s) && s[id+1] == ':' {
+			port = s[id+2:]
+		}
+		return
+	}
+	if strings.Count(s, ":") > 1 {
+		// IPv6 address without brackets can't have port
+		return s, ""
+	}
 	// Common case should has no port, check the last char first
 	if !IsDigit(s[len(s)-1]) {
 		return s, ""
@@ -284,6 +331,7 @@ func ParseRequestURIBytes(rawurl []byte) (*URL, error) {
 const (
 	headerConnection         = "connection"
 	headerContentLength      = "content-length"
+	headerHost               = "host"
 	headerKeepAlive          = "keep-alive"
 	headerProxyAuthenticate  = "proxy-authenticate"
 	headerProxyAuthorization = "proxy-authorization"
@@ -294,8 +342,10 @@ const (
 	headerTransferEncoding   = "transfer-encoding"
 	headerUpgrade            = "upgrade"
 
-	fullHeaderConnection       = "Connection: keep-alive\r\n"
-	fullHeaderTransferEncoding = "Transfer-Encoding: chunked\r\n"
+	fullHeaderConnection                 = "Connection: keep-alive\r\n"
+	fullHeaderConnectionUpgrade          = "Connection: Upgrade\r\n"
+	fullHeaderConnectionKeepAliveUpgrade = "Connection: keep-alive, Upgrade\r\n"
+	fullHeaderTransferEncoding           = "Transfer-Encoding: chunked\r\n"
 )
 
 // Using Go's method expression
@@ -306,6 +356,7 @@ var headerParser = map[string]HeaderParserFunc{
 	headerProxyAuthorization: (*Header).parseProxyAuthorization,
 	headerProxyConnection:    (*Header).parseConnection,
 	headerTransferEncoding:   (*Header).parseTransferEncoding,
+	headerUpgrade:            (*Header).parseUpgrade,
 }
 
 var hopByHopHeader = map[string]bool{
@@ -323,6 +374,11 @@ type HeaderParserFunc func(*Header, []byte, *bytes.Buffer) error
 
 func (h *Header) parseConnection(s []byte, raw *bytes.Buffer) error {
 	h.ConnectionKeepAlive = bytes.Contains(s, []byte("keep-alive"))
+	if bytes.Contains(s, []byte("upgrade")) {
+		// Written by writeUpgrade after all headers are parsed.
+		h.ConnectionUpgrade = true
+		return nil
+	}
 	raw.WriteString(fullHeaderConnection)
 	return nil
 }
@@ -350,6 +406,33 @@ func (h *Header) parseProxyAuthorization(s []byte, raw *bytes.Buffer) error {
 	return nil
 }
 
+func (h *Header) parseUpgrade(s []byte, raw *bytes.Buffer) error {
+	h.Upgrade = string(s)
+	return nil
+}
+
+// writeUpgrade should be called after parsing header. Upgrade is hop-by-hop
+// header, but it's passed on if upgrade is true and Connection lists upgrade,
+// as COW can tunnel the connection after protocol switch. Otherwise Upgrade
+// is dropped, e.g. Apache sends "Upgrade: h2,h2c" on ordinary response.
+func (h *Header) writeUpgrade(raw *bytes.Buffer, upgrade bool) {
+	if !h.ConnectionUpgrade {
+		h.Upgrade = ""
+		return
+	}
+	if !upgrade || h.Upgrade == "" {
+		h.ConnectionUpgrade, h.Upgrade = false, ""
+		raw.WriteString(fullHeaderConnection)
+		return
+	}
+	if h.ConnectionKeepAlive {
+		raw.WriteString(fullHeaderConnectionKeepAliveUpgrade)
+	} else {
+		raw.WriteString(fullHeaderConnectionUpgrade)
+	}
+	raw.WriteString("Upgrade: " + h.Upgrade + CRLF)
+}
+
 func (h *Header) parseTransferEncoding(s []byte, raw *bytes.Buffer) error {
 	// For transfer-encoding: identify, it's the same as specifying neither
 	// content-length nor transfer-encoding.
@@ -477,7 +560,8 @@ func parseRequest(c *clientConn, r *Request) (err error) {
 		errl.Printf("Parsing request header: %v\n", err)
 		return err
 	}
-	if !r.ConnectionKeepAlive {
+	r.writeUpgrade(r.raw, true)
+	if !r.ConnectionKeepAlive && !r.ConnectionUpgrade {
 		// Always add one connection header for request
 		r.raw.WriteString(fullHeaderConnection)
 	}
@@ -498,6 +582,11 @@ func skipCRLF(r *bufio.Reader) error {
 	return nil
 }
 
+// 101 Switching Protocols
+func (rp *Response) switchProtocol() bool {
+	return rp.Status == 101
+}
+
 // If an http response may have message body
 func (rp *Response) hasBody(method string) bool {
 	if method == "HEAD" || rp.Status == 304 || rp.Status == 204 ||
@@ -561,6 +650,13 @@ func parseResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 		errl.Printf("Reading response header: %v %v\n", err, r)
 		return err
 	}
+	// Only pass on Upgrade when the server switches protocol.
+	rp.writeUpgrade(rp.raw, rp.switchProtocol())
+	if rp.switchProtocol() {
+		// The connection will become a tunnel, no more response.
+		rp.raw.WriteString(CRLF)
+		return nil
+	}
 	// Connection close, no content length specification
 	// Use chunked encoding to pass content back to client
 	if !rp.ConnectionKeepAlive && !rp.Chunking && rp.ContLen == -1 {
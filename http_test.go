@@ -18,6 +18,10 @@ func TestSplitHostPort(t *testing.T) {
 		{"google.com:80", "google.com", "80"},
 		{"google.com80", "google.com80", ""},
 		{":7777", "", "7777"},
+		{"[::1]:8080", "::1", "8080"},
+		{"[2001:db8::1]", "2001:db8::1", ""},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"[::]:7777", "::", "7777"},
 	}
 
 	for _, td := range testData {
@@ -41,13 +45,15 @@ func TestParseRequestURI(t *testing.T) {
 		{"http://g.com:80/ncr", &URL{"g.com:80", "g.com", "80", "g.com", "/ncr"}},
 		{"https://g.com/ncr/tree", &URL{"g.com:443", "g.com", "443", "g.com", "/ncr/tree"}},
 		{"www.g.com.hk:80/", &URL{"www.g.com.hk:80", "www.g.com.hk", "80", "g.com.hk", "/"}},
-		{"g.com.jp:80", &URL{"g.com.jp:80", "g.com.jp", "80", "g.com.jp", ""}},
+		{"g.co.jp:80", &URL{"g.co.jp:80", "g.co.jp", "80", "g.co.jp", ""}},
 		{"g.com", &URL{"g.com:80", "g.com", "80", "g.com", ""}},
 		{"g.com:8000/ncr", &URL{"g.com:8000", "g.com", "8000", "g.com", "/ncr"}},
 		{"g.com/ncr/tree", &URL{"g.com:80", "g.com", "80", "g.com", "/ncr/tree"}},
 		{"simplehost", &URL{"simplehost:80", "simplehost", "80", "", ""}},
 		{"simplehost:8080", &URL{"simplehost:8080", "simplehost", "8080", "", ""}},
 		{"192.168.1.1:8080/", &URL{"192.168.1.1:8080", "192.168.1.1", "8080", "", "/"}},
+		{"http://[::1]:8080/", &URL{"[::1]:8080", "::1", "8080", "", "/"}},
+		{"[2001:db8::1]/ncr", &URL{"[2001:db8::1]:80", "2001:db8::1", "80", "", "/ncr"}},
 	}
 	for _, td := range testData {
 		url, err := ParseRequestURI(td.rawurl)
@@ -94,6 +100,20 @@ func TestParseHeader(t *testing.T) {
 			"Connection: keep-alive\r\nTransfer-Encoding: chunked\r\n",
 			&Header{ContLen: -1, Chunking: true, ConnectionKeepAlive: true,
 				KeepAlive: 10 * time.Second}},
+		{"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n",
+			&Header{ContLen: -1, ConnectionUpgrade: true, Upgrade: "websocket"}},
+		{"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n\r\n",
+			"Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n",
+			&Header{ContLen: -1, ConnectionKeepAlive: true, ConnectionUpgrade: true, Upgrade: "websocket"}},
+		// Upgrade not listed in Connection
+		{"Connection: keep-alive\r\nUpgrade: h2c\r\n\r\n",
+			"Connection: keep-alive\r\n",
+			&Header{ContLen: -1, ConnectionKeepAlive: true}},
+		// Connection lists upgrade without Upgrade header
+		{"Connection: Upgrade\r\n\r\n",
+			"Connection: keep-alive\r\n",
+			&Header{ContLen: -1}},
 		/*
 			{"Connection: keep-alive\r\nKeep-Alive: max=5,\r\n timeout=10\r\n\r\n", // test multi-line header
 				"Connection: keep-alive\r\n",
@@ -108,6 +128,7 @@ func TestParseHeader(t *testing.T) {
 		var h Header
 		var newraw bytes.Buffer
 		h.parseHeader(bufio.NewReader(strings.NewReader(td.raw)), &newraw, nil)
+		h.writeUpgrade(&newraw, true)
 		if h.ContLen != td.header.ContLen {
 			t.Errorf("%q parsed content length wrong, should be %d, get %d\n",
 				td.raw, td.header.ContLen, h.ContLen)
@@ -124,9 +145,30 @@ func TestParseHeader(t *testing.T) {
 			t.Errorf("%q parsed keep alive wrong, should be %v, get %v\n",
 				td.raw, td.header.KeepAlive, h.KeepAlive)
 		}
+		if h.ConnectionUpgrade != td.header.ConnectionUpgrade || h.Upgrade != td.header.Upgrade {
+			t.Errorf("%q parsed upgrade wrong, should be %t %q, get %t %q\n",
+				td.raw, td.header.ConnectionUpgrade, td.header.Upgrade,
+				h.ConnectionUpgrade, h.Upgrade)
+		}
 		if newraw.String() != td.newraw {
 			t.Errorf("%q parsed raw wrong\nshould be: %q\ngot: %q\n",
 				td.raw, td.newraw, newraw.Bytes())
 		}
 	}
 }
+
+func TestWriteUpgradeResponse(t *testing.T) {
+	// Apache sends Upgrade on ordinary response
+	raw := "Upgrade: h2,h2c\r\nConnection: Upgrade, Keep-Alive\r\n\r\n"
+	var h Header
+	var newraw bytes.Buffer
+	h.parseHeader(bufio.NewReader(strings.NewReader(raw)), &newraw, nil)
+	h.writeUpgrade(&newraw, false)
+	if !h.ConnectionKeepAlive || h.ConnectionUpgrade || h.Upgrade != "" {
+		t.Errorf("upgrade should be dropped and keep alive, got %t %t %q\n",
+			h.ConnectionKeepAlive, h.ConnectionUpgrade, h.Upgrade)
+	}
+	if newraw.String() != fullHeaderConnection {
+		t.Errorf("raw should be %q, got %q\n", fullHeaderConnection, newraw.Bytes())
+	}
+}
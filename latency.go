@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Latency based load balancing. Connection time to each parent proxy is
+// measured and kept as moving average. The parent with the lowest latency is
+// used if it's healthy. Other parents are probed occasionally so their
+// latency is kept up to date.
+
+const (
+	latencyWeight    = 0.25 // weight of new sample in the moving average
+	latencyProbeRate = 20   // probe a random parent every this number of connections
+)
+
+type latencyStat struct {
+	avg     time.Duration // exponential moving average
+	last    time.Duration
+	samples int
+}
+
+func updateLatency(i int, d time.Duration) {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	lt := &st.latency
+	if lt.samples == 0 {
+		lt.avg = d
+	} else {
+		lt.avg = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(lt.avg))
+	}
+	lt.last = d
+	lt.samples++
+	st.mu.Unlock()
+}
+
+func parentProxyLatency(i int) latencyStat {
+	st := parentProxy[i].Stats()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.latency
+}
+
+// latencyProxyId returns the parent proxy to try first in latency mode.
+func latencyProxyId() int {
+	if rand.Intn(latencyProbeRate) == 0 {
+		return rand.Intn(len(parentProxy))
+	}
+	best := -1
+	var bestAvg time.Duration
+	for i := range parentProxy {
+		if !parentProxyUp(i) {
+			continue
+		}
+		lt := parentProxyLatency(i)
+		if lt.samples == 0 {
+			// measure healthy parent first
+			return i
+		}
+		if best == -1 || lt.avg < bestAvg {
+			best, bestAvg = i, lt.avg
+		}
+	}
+	if best == -1 {
+		// all down, the caller will try them in order
+		return 0
+	}
+	return best
+}
+
+var loadBalanceName = [...]string{
+	loadBalanceBackup:  "backup",
+	loadBalanceHash:    "hash",
+	loadBalanceLatency: "latency",
+}
+
+func genParentProxyStat() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n" +
+		"Content-Type: text/plain\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n")
+	fmt.Fprintf(buf, "load balance: %s\n\n", loadBalanceName[config.LoadBalance])
+	fmt.Fprintf(buf, "%-40s %10s %10s %8s %-6s %8s\n", "parent proxy", "avg", "last", "samples", "health", "failcnt")
+
+	for i, pp := range parentProxy {
+		lt := parentProxyLatency(i)
+		avg, last := "-", "-"
+		if lt.samples > 0 {
+			avg = lt.avg.Round(time.Millisecond).String()
+			last = lt.last.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(buf, "%-40s %10s %10s %8d %s\n", pp.Name(), avg, last,
+			lt.samples, parentProxyHealthString(i))
+	}
+	buf.WriteString("\n")
+	buf.Write(genDNSStat())
+	return buf.Bytes()
+}
+
+func sendParentProxyStat(c *clientConn) {
+	if _, err := c.Write(genParentProxyStat()); err != nil {
+		debug.Println("Error sending parent proxy stat")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateLatency(t *testing.T) {
+	defer initTestParentProxy(nil)()
+
+	updateLatency(0, 100*time.Millisecond)
+	if lt := parentProxyLatency(0); lt.avg != 100*time.Millisecond || lt.samples != 1 {
+		t.Error("first sample should be the average, got", lt.avg)
+	}
+	updateLatency(0, 200*time.Millisecond)
+	if lt := parentProxyLatency(0); lt.avg != 125*time.Millisecond ||
+		lt.last != 200*time.Millisecond || lt.samples != 2 {
+		t.Error("moving average wrong, got", lt.avg)
+	}
+}
+
+func TestLatencyProxyId(t *testing.T) {
+	defer initTestParentProxy(nil, nil, nil, nil)()
+	for i, avg := range []time.Duration{300, 100, 50, 200} {
+		parentProxy[i].Stats().latency = latencyStat{avg: avg * time.Millisecond, samples: 5}
+	}
+	parentProxy[2].Stats().health.down = true
+
+	const n = 1000
+	cnt := make([]int, len(parentProxy))
+	for i := 0; i < n; i++ {
+		cnt[latencyProxyId()]++
+	}
+	if cnt[1] < n*8/10 {
+		t.Error("fastest healthy parent should be used most of the time, got", cnt)
+	}
+	if cnt[1] == n {
+		t.Error("other parents should be probed occasionally")
+	}
+
+	// parent not measured should be tried first
+	parentProxy[3].Stats().latency.samples = 0
+	cnt = make([]int, len(parentProxy))
+	for i := 0; i < n; i++ {
+		cnt[latencyProxyId()]++
+	}
+	if cnt[3] < n*8/10 {
+		t.Error("parent without latency sample should be measured, got", cnt)
+	}
+}
@@ -19,8 +19,14 @@ func sigHandler() {
 		syscall.SIGHUP)
 
 	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			info.Println("SIGHUP caught, reload config and site lists")
+			reload()
+			continue
+		}
 		info.Printf("%v caught, exit\n", sig)
 		storeSiteStat()
+		closeParentProxy()
 		break
 	}
 	/*
@@ -44,15 +50,20 @@ func main() {
 	parseConfig(cmdLineConfig.RcFile)
 	updateConfig(cmdLineConfig)
 	checkConfig()
+	initReloadableConfig()
 
 	initLog()
 	initAuth()
 	initSocksServer()
 	initShadowSocks()
+	initSSH()
+	// domain of site depends on public suffix list
+	loadPublicSuffixList(dsFile.publicSuffix)
 	initSiteStat()
+	initParentRoute()
 	initPAC() // initPAC uses siteStat, so must init after site stat
 
-	if len(parentProxyCreator) == 0 {
+	if len(parentProxy) == 0 {
 		info.Println("no parent proxy server, can't handle blocked sites")
 	} else {
 		hasParentProxy = true
@@ -73,18 +84,28 @@ func main() {
 	}
 
 	go sigHandler()
+	go runReloadWatcher()
 	go runSSH()
 	go runEstimateTimeout()
+	go runHealthCheck()
+	go runConnPoolCleaner()
 
 	done := make(chan byte, 1)
 	// save 1 goroutine (a few KB) for the common case with only 1 listen address
 	if len(config.ListenAddr) > 1 {
 		for i, addr := range config.ListenAddr[1:] {
-			go NewProxy(addr, config.AddrInPAC[i+1]).Serve(done)
+			go NewProxy(addr, config.AddrInPAC[i+1], listenTLSConfig(i+1)).Serve(done)
 		}
 	}
-	NewProxy(config.ListenAddr[0], config.AddrInPAC[0]).Serve(done)
-	for i := 0; i < len(config.ListenAddr); i++ {
+	for _, addr := range config.SocksListen {
+		go NewSocksProxy(addr).Serve(done)
+	}
+	for _, addr := range config.TransparentListen {
+		go NewTransparentProxy(addr).Serve(done)
+	}
+	NewProxy(config.ListenAddr[0], config.AddrInPAC[0], listenTLSConfig(0)).Serve(done)
+	nserver := len(config.ListenAddr) + len(config.SocksListen) + len(config.TransparentListen)
+	for i := 0; i < nserver; i++ {
 		<-done
 	}
 }
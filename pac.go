@@ -5,19 +5,25 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
 var pac struct {
-	template       *template.Template
-	topLevelDomain string
-	directList     string
+	template *template.Template
+
+	// updated periodically and upon reload
+	sync.RWMutex
+	publicSuffix string
+	directList   string
+	userRules    string
+	importRules  string
 }
 
 func init() {
 	const pacRawTmpl = `var direct = 'DIRECT';
-var httpProxy = 'PROXY {{.ProxyAddr}}; DIRECT';
+var httpProxy = '{{.ProxyType}} {{.ProxyAddr}}; DIRECT';
 
 var directList = [
 "",
@@ -29,12 +35,23 @@ for (var i = 0; i < directList.length; i += 1) {
 	directAcc[directList[i]] = true;
 }
 
-var topLevel = {
-{{.TopLevel}}
+var suffixRules = {
+{{.PublicSuffix}}
 };
 
-// only handles IPv4 address now
+var userRules = [
+{{.UserRules}}
+];
+
+var importRules = [
+{{.ImportRules}}
+];
+
 function hostIsIP(host) {
+	// host name can't contain ':', so it's IPv6 address, maybe in brackets
+	if (host.indexOf(':') !== -1) {
+		return true;
+	}
 	var parts = host.split('.');
 	if (parts.length != 4) {
 		return false;
@@ -51,29 +68,91 @@ function hostIsIP(host) {
 	return true;
 }
 
+// publicSuffix returns the public suffix of lower case host, refer to
+// publicsuffix.go for the algorithm. Flags in suffixRules: 1 for normal
+// rule, 2 for wildcard rule on sub domains, 4 for exception rule.
+function publicSuffix(host) {
+	var start = host.lastIndexOf('.') + 1;
+	var ps = host.substring(start);
+	var parent = '';
+	for (;;) {
+		var s = host.substring(start);
+		var flag = suffixRules[s] || 0;
+		if (flag & 4) {
+			return parent;
+		}
+		if ((flag & 1) || (parent !== '' && (suffixRules[parent] & 2))) {
+			ps = s;
+		}
+		if (start === 0) {
+			return ps;
+		}
+		parent = s;
+		start = start < 2 ? 0 : host.lastIndexOf('.', start - 2) + 1;
+	}
+}
+
 function host2domain(host) {
-	var lastDot = host.lastIndexOf('.');
-	if (lastDot === -1) {
+	if (host.indexOf('.') === -1) {
 		return ""; // simple host name has no domain
 	}
-	// Find the second last dot
-	dot2ndLast = host.lastIndexOf(".", lastDot-1);
-	if (dot2ndLast === -1)
+	var ps = publicSuffix(host.toLowerCase());
+	if (ps.length >= host.length) {
 		return host;
+	}
+	var dot = host.lastIndexOf('.', host.length - ps.length - 2);
+	return host.substring(dot + 1);
+}
+
+function ip4ToNum(ip) {
+	var parts = ip.split('.');
+	return ((parts[0] << 24) | (parts[1] << 16) | (parts[2] << 8) | parts[3]) >>> 0;
+}
+
+function ruleMatch(r, url, host, isIP) {
+	if (r.mask !== undefined) {
+		return isIP && host.indexOf(':') === -1 && ((ip4ToNum(host) & r.mask) >>> 0) === r.net;
+	}
+	if (isIP) {
+		return false;
+	}
+	if (r.re !== undefined) {
+		return r.re.test(r.url ? url : host);
+	}
+	if (r.host !== undefined) {
+		return host === r.host;
+	}
+	return host === r.suffix || host.slice(-r.suffix.length-1) === '.' + r.suffix;
+}
 
-	var part = host.substring(dot2ndLast+1, lastDot);
-	if (topLevel[part]) {
-		var dot3rdLast = host.lastIndexOf(".", dot2ndLast-1);
-		if (dot3rdLast === -1) {
-			return host;
+// matchRule returns null if no rule matches.
+function matchRule(url, host, isIP, rules) {
+	for (var i = 0; i < rules.length; i += 1) {
+		if (ruleMatch(rules[i], url, host, isIP)) {
+			return rules[i].proxy ? httpProxy : direct;
 		}
-		return host.substring(dot3rdLast+1);
 	}
-	return host.substring(dot2ndLast+1);
+	return null;
 }
 
 function FindProxyForURL(url, host) {
-	return (hostIsIP(host) || directAcc[host] || directAcc[host2domain(host)]) ? direct : httpProxy;
+	host = host.toLowerCase();
+	if (directAcc[host]) {
+		return direct;
+	}
+	var isIP = hostIsIP(host);
+	var res = matchRule(url, host, isIP, userRules);
+	if (res !== null) {
+		return res;
+	}
+	if (!isIP && directAcc[host2domain(host)]) {
+		return direct;
+	}
+	res = matchRule(url, host, isIP, importRules);
+	if (res !== null) {
+		return res;
+	}
+	return isIP ? direct : httpProxy;
 }
 `
 	var err error
@@ -81,12 +160,6 @@ function FindProxyForURL(url, host) {
 	if err != nil {
 		Fatal("Internal error on generating pac file template:", err)
 	}
-
-	var buf bytes.Buffer
-	for k, _ := range topLevelDomain {
-		buf.WriteString(fmt.Sprintf("\t\"%s\": true,\n", k))
-	}
-	pac.topLevelDomain = buf.String()[:buf.Len()-2] // remove the final comma
 }
 
 // No need for content-length as we are closing connection
@@ -102,24 +175,37 @@ func genPAC(c *clientConn) []byte {
 		host, _ := splitHostPort(c.LocalAddr().String())
 		proxyAddr = net.JoinHostPort(host, c.proxy.port)
 	}
+	// Browsers use "HTTPS host:port" for HTTP proxy over TLS.
+	proxyType := "PROXY"
+	if c.proxy.tlsConfig != nil {
+		proxyType = "HTTPS"
+	}
 
-	if pac.directList == "" {
+	pac.RLock()
+	defer pac.RUnlock()
+	if pac.directList == "" && pac.userRules == "" && pac.importRules == "" {
 		// Empty direct domain list
 		buf.Write(pacHeader)
-		pacproxy := fmt.Sprintf("function FindProxyForURL(url, host) { return 'PROXY %s; DIRECT'; };",
-			proxyAddr)
+		pacproxy := fmt.Sprintf("function FindProxyForURL(url, host) { return '%s %s; DIRECT'; };",
+			proxyType, proxyAddr)
 		buf.Write([]byte(pacproxy))
 		return buf.Bytes()
 	}
 
 	data := struct {
+		ProxyType     string
 		ProxyAddr     string
 		DirectDomains string
-		TopLevel      string
+		PublicSuffix  string
+		UserRules     string
+		ImportRules   string
 	}{
+		proxyType,
 		proxyAddr,
 		pac.directList,
-		pac.topLevelDomain,
+		pac.publicSuffix,
+		pac.userRules,
+		pac.importRules,
 	}
 
 	buf.Write(pacHeader)
@@ -131,15 +217,39 @@ func genPAC(c *clientConn) []byte {
 }
 
 func initPAC() {
-	pac.directList = strings.Join(siteStat.GetDirectList(), "\",\n\"")
+	updatePACRules()
+	updatePACDirectList()
 	go func() {
 		for {
 			time.Sleep(10 * time.Minute)
-			pac.directList = strings.Join(siteStat.GetDirectList(), "\",\n\"")
+			updatePACDirectList()
 		}
 	}()
 }
 
+func updatePACRules() {
+	siteStat.ruleLock.RLock()
+	userRules := genPACRules(siteStat.userRules)
+	importRules := genPACRules(siteStat.importRules)
+	siteStat.ruleLock.RUnlock()
+
+	pac.Lock()
+	pac.userRules, pac.importRules = userRules, importRules
+	pac.Unlock()
+}
+
+// updatePACDirectList also updates public suffix rules as only rules
+// related to domains in direct list are included in PAC.
+func updatePACDirectList() {
+	lst := siteStat.GetDirectList()
+	publicSuffix := genPACPublicSuffix(lst)
+	directList := strings.Join(lst, "\",\n\"")
+
+	pac.Lock()
+	pac.publicSuffix, pac.directList = publicSuffix, directList
+	pac.Unlock()
+}
+
 func sendPAC(c *clientConn) {
 	if _, err := c.Write(genPAC(c)); err != nil {
 		debug.Println("Error sending PAC file")
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Parent proxy abstraction. Each type of parent proxy implements ParentProxy
+// and registers a factory for its URL scheme, so the proxy option
+// "scheme://[userinfo@]host:port" can create it. New types of parent proxy
+// can be added this way without changing config parsing and connection
+// creation code.
+
+// ParentProxy creates connections to web servers through a parent proxy.
+type ParentProxy interface {
+	// Dial connects to url through the parent proxy.
+	Dial(url *URL) (conn, error)
+	// Name is used in log and stat page, e.g. "socks5 127.0.0.1:1080".
+	Name() string
+	// Stats returns statistics kept by COW for the parent proxy.
+	// Implementations can embed ParentProxyStats to provide this method.
+	Stats() *ParentProxyStats
+	// Close releases resources held by the parent proxy.
+	Close() error
+}
+
+// ParentProxyFactory creates a parent proxy from the server address and the
+// optional userinfo part of proxy URL.
+type ParentProxyFactory func(server, userInfo string) (ParentProxy, error)
+
+var parentProxyFactory = make(map[string]ParentProxyFactory)
+
+// RegisterParentProxy registers factory for proxy URL scheme. Should be
+// called in init function.
+func RegisterParentProxy(scheme string, f ParentProxyFactory) {
+	if _, ok := parentProxyFactory[scheme]; ok {
+		panic("parent proxy scheme registered twice: " + scheme)
+	}
+	parentProxyFactory[scheme] = f
+}
+
+// ParentProxyStats contains latency and health status of a parent proxy.
+type ParentProxyStats struct {
+	mu      sync.Mutex
+	latency latencyStat
+	health  parentHealth
+}
+
+func (st *ParentProxyStats) Stats() *ParentProxyStats {
+	return st
+}
+
+// parentProxy contains all parent proxies in the order of config.
+var parentProxy []ParentProxy
+
+func addParentProxy(pp ParentProxy) {
+	parentProxy = append(parentProxy, pp)
+}
+
+func closeParentProxy() {
+	for _, pp := range parentProxy {
+		pp.Close()
+	}
+}
+
+func dialParent(i int, url *URL) (srvconn conn, err error) {
+	start := time.Now()
+	srvconn, err = parentProxy[i].Dial(url)
+	if err != nil {
+		parentProxyFailed(i)
+		return
+	}
+	parentProxySucceeded(i)
+	updateLatency(i, time.Now().Sub(start))
+	return
+}
+
+func createParentProxyConnection(url *URL) (srvconn conn, err error) {
+	if ids := routeProxyIds(url); ids != nil {
+		return connectParentProxy(ids, url)
+	}
+	nproxy := len(parentProxy)
+	if nproxy == 0 {
+		return zeroConn, errNoParentProxy
+	}
+
+	firstId := 0
+	switch config.LoadBalance {
+	case loadBalanceHash:
+		firstId = int(stringHash(url.Host) % uint64(nproxy))
+	case loadBalanceLatency:
+		firstId = latencyProxyId()
+	}
+	ids := make([]int, nproxy)
+	for i := range ids {
+		ids[i] = (firstId + i) % nproxy
+	}
+	return connectParentProxy(ids, url)
+}
+
+// connectParentProxy tries parent proxies in the order given by ids.
+func connectParentProxy(ids []int, url *URL) (srvconn conn, err error) {
+	var skipped []int
+	for _, proxyId := range ids {
+		// skip parent marked down by health check
+		if !parentProxyUp(proxyId) {
+			skipped = append(skipped, proxyId)
+			continue
+		}
+		if srvconn, err = dialParent(proxyId, url); err == nil {
+			return
+		}
+	}
+	// last resort, try parents marked down, not likely to succeed
+	for _, skippedId := range skipped {
+		if srvconn, err = dialParent(skippedId, url); err == nil {
+			return
+		}
+	}
+	return
+}
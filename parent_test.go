@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+// testParent is a parent proxy with custom dial function.
+type testParent struct {
+	ParentProxyStats
+	name string
+	dial func(*URL) (conn, error)
+}
+
+func (tp *testParent) Dial(url *URL) (conn, error) {
+	cn, err := tp.dial(url)
+	if err == nil {
+		cn.parent = tp
+	}
+	return cn, err
+}
+
+func (tp *testParent) Name() string {
+	return tp.name
+}
+
+func (tp *testParent) Close() error {
+	return nil
+}
+
+// initTestParentProxy sets parent proxies with the given dial functions,
+// returns a function to restore.
+func initTestParentProxy(dial ...func(*URL) (conn, error)) func() {
+	parentProxy = nil
+	for _, f := range dial {
+		addParentProxy(&testParent{name: "test", dial: f})
+	}
+	return func() {
+		parentProxy = nil
+	}
+}
+
+func TestRegisterParentProxy(t *testing.T) {
+	var gotServer, gotUserInfo string
+	RegisterParentProxy("test", func(server, userInfo string) (ParentProxy, error) {
+		gotServer, gotUserInfo = server, userInfo
+		return &testParent{name: "test " + server}, nil
+	})
+	defer func() {
+		delete(parentProxyFactory, "test")
+		parentProxy = nil
+		config.Proxy = nil
+	}()
+
+	parser := configParser{}
+	parser.ParseProxy("TEST://user:p@ss@127.0.0.1:9999")
+	if gotServer != "127.0.0.1:9999" || gotUserInfo != "user:p@ss" {
+		t.Errorf("factory got server %s userinfo %s\n", gotServer, gotUserInfo)
+	}
+	if len(parentProxy) != 1 || parentProxy[0].Name() != "test 127.0.0.1:9999" {
+		t.Error("registered parent proxy type not added")
+	}
+	if parentProxy[0].Stats() == nil {
+		t.Error("embedded ParentProxyStats should provide stats")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Process wide pool of idle server connections. When a client connection is
+// closed, its idle keep-alive server connections are put into the pool
+// instead of being closed, so other client connections requesting the same
+// server can reuse them, avoiding TCP and parent proxy handshake.
+//
+// Connections are keyed by host:port and the parent proxy used (nil for direct
+// connection). Connections are taken from the pool following the same rules
+// as creating new connections: sites using parent proxy never get direct
+// connections, and parent route and health are respected. Idle connections
+// expire at willCloseOn, which is set according to server's keep-alive
+// timeout. Connections closed by the server are detected before reuse.
+
+const (
+	maxIdleConnPerHost    = 4 // for each host:port and parent proxy
+	maxIdleConn           = 256
+	idleConnCleanInterval = 10 * time.Second
+)
+
+type connPoolKey struct {
+	hostPort string
+	parent   ParentProxy
+}
+
+func (key connPoolKey) String() string {
+	if key.parent == nil {
+		return key.hostPort + " direct"
+	}
+	return key.hostPort + " via " + key.parent.Name()
+}
+
+type serverConnPool struct {
+	sync.Mutex
+	idle map[connPoolKey][]*serverConn // last one is most recently put
+	cnt  int
+}
+
+var connPool = newServerConnPool()
+
+func newServerConnPool() *serverConnPool {
+	return &serverConnPool{idle: make(map[connPoolKey][]*serverConn)}
+}
+
+// reusable returns true if the response of the last request is finished and
+// the server may keep the connection open.
+func (sv *serverConn) reusable() bool {
+	return sv.idle && sv.pending == 0 && !sv.mayBeClosed() &&
+		(sv.bufRd == nil || sv.bufRd.Buffered() == 0)
+}
+
+// closedByServer checks whether the server has closed the idle connection or
+// sent unexpected data.
+func (sv *serverConn) closedByServer() bool {
+	if sv.connType == ctSshConn {
+		// ssh channel has no deadline support, rely on willCloseOn
+		return false
+	}
+	var b [1]byte
+	sv.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := sv.Read(b[:])
+	sv.SetReadDeadline(zeroTime)
+	return n > 0 || !isErrTimeout(err)
+}
+
+// put returns false if sv is not put into the pool and should be closed by
+// the caller.
+func (p *serverConnPool) put(sv *serverConn) bool {
+	if !sv.reusable() {
+		return false
+	}
+	key := connPoolKey{sv.url.HostPort, sv.parent}
+	p.Lock()
+	if p.cnt >= maxIdleConn || len(p.idle[key]) >= maxIdleConnPerHost {
+		p.Unlock()
+		return false
+	}
+	p.idle[key] = append(p.idle[key], sv)
+	p.cnt++
+	p.Unlock()
+
+	sv.releaseBuf()
+	debug.Println("idle server conn put into pool:", key)
+	return true
+}
+
+func (p *serverConnPool) getByKey(key connPoolKey) *serverConn {
+	for {
+		p.Lock()
+		lst := p.idle[key]
+		if len(lst) == 0 {
+			p.Unlock()
+			return nil
+		}
+		sv := lst[len(lst)-1]
+		if len(lst) == 1 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = lst[:len(lst)-1]
+		}
+		p.cnt--
+		p.Unlock()
+
+		if !sv.mayBeClosed() && !sv.closedByServer() {
+			debug.Println("reuse idle server conn:", key)
+			return sv
+		}
+		sv.Close()
+	}
+}
+
+// get returns an idle connection to url, nil if there's none. Direct
+// connection is not used if the site would use parent proxy when creating
+// new connection, i.e. always using parent proxy, having parent route or
+// considered as blocked. Only connections through parents in the route and
+// not marked down are used.
+func (p *serverConnPool) get(url *URL, siteInfo *VisitCnt) *serverConn {
+	ids := routeProxyIds(url)
+	useParent := hasParentProxy &&
+		(rconfig().AlwaysProxy || ids != nil || siteInfo.AsBlocked())
+	if !useParent {
+		if sv := p.getByKey(connPoolKey{url.HostPort, nil}); sv != nil {
+			return sv
+		}
+		if siteInfo.AlwaysDirect() {
+			return nil
+		}
+	}
+	if ids == nil {
+		ids = make([]int, len(parentProxy))
+		for i := range ids {
+			ids[i] = i
+		}
+	}
+	for _, id := range ids {
+		if !parentProxyUp(id) {
+			continue
+		}
+		if sv := p.getByKey(connPoolKey{url.HostPort, parentProxy[id]}); sv != nil {
+			return sv
+		}
+	}
+	return nil
+}
+
+// closeExpired closes connections that may have been closed by server.
+func (p *serverConnPool) closeExpired() {
+	var expired []*serverConn
+	p.Lock()
+	for key, lst := range p.idle {
+		n := 0
+		for _, sv := range lst {
+			if sv.mayBeClosed() {
+				expired = append(expired, sv)
+			} else {
+				lst[n] = sv
+				n++
+			}
+		}
+		if n == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = lst[:n]
+		}
+	}
+	p.cnt -= len(expired)
+	p.Unlock()
+
+	for _, sv := range expired {
+		sv.Close()
+	}
+}
+
+func runConnPoolCleaner() {
+	for {
+		time.Sleep(idleConnCleanInterval)
+		connPool.closeExpired()
+	}
+}
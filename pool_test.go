@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServerConn returns an idle serverConn connected to a server which
+// accepts connections on ln, through parent if it's not nil. The server side
+// of the connection is returned.
+func newTestServerConn(t *testing.T, ln net.Listener, parent ParentProxy) (*serverConn, net.Conn) {
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	srv, err := ln.Accept()
+	if err != nil {
+		t.Fatal("accept:", err)
+	}
+	url, _ := ParseRequestURI("www.example.com")
+	ct := ctDirectConn
+	if parent != nil {
+		ct = ctSocksConn
+	}
+	sv := newServerConn(conn{c, ct, parent}, url, newVisitCnt(0, 0))
+	sv.idle = true
+	sv.willCloseOn = time.Now().Add(time.Minute)
+	return sv, srv
+}
+
+func TestConnPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	hasParentProxy = true
+	defer func() { hasParentProxy = false }()
+	defer initTestParentProxy(nil)()
+	p := newServerConnPool()
+	url, _ := ParseRequestURI("www.example.com")
+
+	sv, srv := newTestServerConn(t, ln, parentProxy[0])
+	defer srv.Close()
+	if !p.put(sv) {
+		t.Fatal("idle connection should be put into pool")
+	}
+	if p.get(url, newVisitCnt(userCnt, 0)) != nil {
+		t.Error("always direct site should not use parent proxy connection")
+	}
+	if got := p.get(url, newVisitCnt(0, 0)); got != sv {
+		t.Error("should get idle connection from pool")
+	}
+	if p.cnt != 0 || p.get(url, newVisitCnt(0, 0)) != nil {
+		t.Error("connection should be removed from pool after get")
+	}
+
+	// connection closed by server should not be reused
+	sv, srv = newTestServerConn(t, ln, nil)
+	p.put(sv)
+	srv.Close()
+	time.Sleep(50 * time.Millisecond)
+	if p.get(url, newVisitCnt(0, 0)) != nil {
+		t.Error("connection closed by server should not be reused")
+	}
+
+	// busy connection should not be put into pool
+	sv, srv = newTestServerConn(t, ln, nil)
+	defer srv.Close()
+	sv.idle = false
+	if p.put(sv) {
+		t.Error("connection with unfinished response should not be put into pool")
+	}
+	sv.Close()
+}
+
+func TestConnPoolLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	p := newServerConnPool()
+
+	var svs []*serverConn
+	for i := 0; i < maxIdleConnPerHost+1; i++ {
+		sv, srv := newTestServerConn(t, ln, nil)
+		defer srv.Close()
+		defer sv.Close()
+		svs = append(svs, sv)
+	}
+	for i, sv := range svs {
+		if ok := p.put(sv); ok != (i < maxIdleConnPerHost) {
+			t.Errorf("put %d connection to the same host returns %v\n", i+1, ok)
+		}
+	}
+
+	svs[0].willCloseOn = time.Now().Add(-time.Second)
+	p.closeExpired()
+	if p.cnt != maxIdleConnPerHost-1 {
+		t.Errorf("expired connection not removed, %d left\n", p.cnt)
+	}
+}
+
+func TestConnPoolGetParent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	hasParentProxy = true
+	defer func() { hasParentProxy = false }()
+	defer initTestParentProxy(nil, nil)()
+	p := newServerConnPool()
+	url, _ := ParseRequestURI("www.example.com")
+
+	var srvs []net.Conn
+	defer func() {
+		for _, srv := range srvs {
+			srv.Close()
+		}
+	}()
+	put := func(parent ParentProxy) *serverConn {
+		sv, srv := newTestServerConn(t, ln, parent)
+		srvs = append(srvs, srv)
+		if !p.put(sv) {
+			t.Fatal("idle connection should be put into pool")
+		}
+		return sv
+	}
+	direct := put(nil)
+	sv0 := put(parentProxy[0])
+	sv1 := put(parentProxy[1])
+	defer direct.Close()
+	defer sv0.Close()
+	defer sv1.Close()
+
+	// blocked site should never get direct connection
+	if got := p.get(url, newVisitCnt(0, userCnt)); got != sv0 {
+		t.Error("blocked site should get connection through parent proxy")
+	}
+	p.put(sv0)
+
+	// only parents in route are used
+	parentRoute = map[string][]int{"example.com": {1}}
+	defer func() {
+		parentRoute = make(map[string][]int)
+	}()
+	if got := p.get(url, newVisitCnt(userCnt, 0)); got != sv1 {
+		t.Error("routed site should get connection through parent in route")
+	}
+	p.put(sv1)
+
+	// parent marked down is skipped
+	setParentProxyHealth(1, errHealthCheckResponse)
+	if got := p.get(url, newVisitCnt(0, 0)); got != nil {
+		t.Error("should not get connection through parent marked down")
+	}
+	parentRoute = make(map[string][]int)
+	if got := p.get(url, newVisitCnt(0, 0)); got != direct {
+		t.Error("site without route should prefer direct connection")
+	}
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/cyfdecyf/bufio"
 	"github.com/cyfdecyf/leakybuf"
 	"io"
-	"math/rand"
 	"net"
 	// "reflect"
 	"strings"
@@ -64,7 +65,8 @@ func isErrRetry(err error) bool {
 type Proxy struct {
 	addr      string // listen address, contains port
 	port      string
-	addrInPAC string // proxy server address to use in PAC
+	addrInPAC string      // proxy server address to use in PAC
+	tlsConfig *tls.Config // not nil for TLS listener
 }
 
 type connType byte
@@ -75,6 +77,7 @@ const (
 	ctSocksConn
 	ctShadowctSocksConn
 	ctHttpProxyConn
+	ctSshConn
 )
 
 var ctName = [...]string{
@@ -83,6 +86,7 @@ var ctName = [...]string{
 	ctSocksConn:         "socks5",
 	ctShadowctSocksConn: "shadowsocks",
 	ctHttpProxyConn:     "http parent",
+	ctSshConn:           "ssh",
 }
 
 type serverConnState byte
@@ -96,6 +100,7 @@ const (
 type conn struct {
 	net.Conn
 	connType
+	parent ParentProxy // nil for direct connection
 }
 
 var zeroConn conn
@@ -111,14 +116,23 @@ type serverConn struct {
 	siteInfo    *VisitCnt
 	visited     bool
 	timeoutSet  bool
+	pending     int  // number of requests waiting for response
+	idle        bool // response finished, can be put into connection pool
 }
 
 type clientConn struct {
-	net.Conn   // connection to the proxy client
-	bufRd      *bufio.Reader
-	buf        []byte                 // buffer for the buffered reader
-	serverConn map[string]*serverConn // request serverConn, host:port as key
-	proxy      *Proxy
+	net.Conn    // connection to the proxy client
+	bufRd       *bufio.Reader
+	buf         []byte                 // buffer for the buffered reader
+	serverConn  map[string]*serverConn // request serverConn, host:port as key
+	proxy       *Proxy
+	socks       bool // client uses SOCKS5, only CONNECT request is possible
+	transparent bool // connection redirected by iptables, handled like CONNECT
+	authed      bool
+
+	pipeline     []pipelinedRequest // requests sent in advance, in client order
+	readAhead    *Request           // request read in advance but not pipelined
+	readAheadErr error              // error reading readAhead
 }
 
 var (
@@ -136,9 +150,28 @@ var (
 	errAuthRequired    = errors.New("Authentication requried")
 )
 
-func NewProxy(addr, addrInPAC string) *Proxy {
+func NewProxy(addr, addrInPAC string, tlsConfig *tls.Config) *Proxy {
 	_, port := splitHostPort(addr)
-	return &Proxy{addr: addr, port: port, addrInPAC: addrInPAC}
+	return &Proxy{addr: addr, port: port, addrInPAC: addrInPAC, tlsConfig: tlsConfig}
+}
+
+// listenTLSConfig returns TLS config for the ith listen address, nil if it's
+// not a TLS listen address. Must be called after initAuth.
+func listenTLSConfig(i int) *tls.Config {
+	if config.ListenCert[i] == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(expandTilde(config.ListenCert[i]), expandTilde(config.ListenKey[i]))
+	if err != nil {
+		Fatal("loading certificate for listen address", config.ListenAddr[i], err)
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if auth.clientCA != nil {
+		// Client without certificate can still use other authentication method.
+		tc.ClientCAs = auth.clientCA
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc
 }
 
 func (py *Proxy) Serve(done chan byte) {
@@ -150,13 +183,18 @@ func (py *Proxy) Serve(done chan byte) {
 		fmt.Println("Server creation failed:", err)
 		return
 	}
+	scheme := "http"
+	if py.tlsConfig != nil {
+		ln = tls.NewListener(ln, py.tlsConfig)
+		scheme = "https"
+	}
 	host, port := splitHostPort(py.addr)
-	if host == "" || host == "0.0.0.0" {
-		info.Printf("COW proxy address %s, PAC url http://<hostip>:%s/pac\n", py.addr, port)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		info.Printf("COW proxy address %s, PAC url %s://<hostip>:%s/pac\n", py.addr, scheme, port)
 	} else if py.addrInPAC == "" {
-		info.Printf("COW proxy address %s, PAC url http://%s/pac\n", py.addr, py.addr)
+		info.Printf("COW proxy address %s, PAC url %s://%s/pac\n", py.addr, scheme, py.addr)
 	} else {
-		info.Printf("COW proxy address %s, PAC url http://%s/pac\n", py.addr, py.addrInPAC)
+		info.Printf("COW proxy address %s, PAC url %s://%s/pac\n", py.addr, scheme, py.addrInPAC)
 	}
 
 	for {
@@ -197,7 +235,9 @@ func (c *clientConn) releaseBuf() {
 func (c *clientConn) Close() error {
 	c.releaseBuf()
 	for _, sv := range c.serverConn {
-		sv.Close()
+		if !connPool.put(sv) {
+			sv.Close()
+		}
 	}
 	if debug {
 		debug.Printf("Client %v connection closed\n", c.RemoteAddr())
@@ -226,11 +266,28 @@ func (c *clientConn) serveSelfURL(r *Request) (err error) {
 		// Send non nil error to close client connection.
 		return errPageSent
 	}
+	if r.URL.Path == "/stat" {
+		sendParentProxyStat(c)
+		return errPageSent
+	}
 end:
 	sendErrorPage(c, "404 not found", "Page not found", "Handling request to proxy itself.")
 	return errPageSent
 }
 
+// selfURLNeedAuth returns true if request to proxy itself should pass
+// authentication first. PAC is served to anyone as browsers fetch it before
+// using the proxy, while stat page which exposes parent proxy addresses is
+// only served to authenticated or loopback clients.
+func (c *clientConn) selfURLNeedAuth(r *Request) bool {
+	if !auth.required || c.authed || r.URL.Path != "/stat" {
+		return false
+	}
+	clientIP, _ := splitHostPort(c.RemoteAddr().String())
+	ip := net.ParseIP(clientIP)
+	return ip == nil || !ip.IsLoopback()
+}
+
 func (c *clientConn) handleRetry(r *Request, sv *serverConn, re error) error {
 	err, ok := re.(RetryError)
 	if !ok {
@@ -269,16 +326,19 @@ func (c *clientConn) handleRetry(r *Request, sv *serverConn, re error) error {
 }
 
 func (c *clientConn) serve() {
-	var r Request
+	var r *Request
 	var rp Response
 	var sv *serverConn
 	var err error
+	var selfURL bool
 
-	var authed bool
 	var authCnt int
 
 	defer func() {
-		r.releaseBuf()
+		if r != nil {
+			r.releaseBuf()
+		}
+		c.releasePipeline()
 		c.Close()
 	}()
 
@@ -286,39 +346,56 @@ func (c *clientConn) serve() {
 	// and response.
 	cnt := 0
 	for {
+		if r != nil {
+			r.releaseBuf()
+		}
 		if c.bufRd == nil || c.buf == nil {
 			errl.Printf("%s client read buffer nil, served %d requests",
 				c.RemoteAddr(), cnt)
-			if r.URL != nil {
-				errl.Println("previous request:", &r)
+			if r != nil && r.URL != nil {
+				errl.Println("previous request:", r)
 			}
 			panic("client read buffer nil")
 		}
 		cnt++
-		if err = c.getRequest(&r); err != nil {
+		if len(c.pipeline) > 0 {
+			// Requests sent in advance have passed the checks below.
+			r, sv = c.pipeline[0].r, c.pipeline[0].sv
+			c.pipeline = c.pipeline[1:]
+			goto serve
+		}
+		if c.readAhead != nil {
+			r, err = c.readAhead, c.readAheadErr
+			c.readAhead, c.readAheadErr = nil, nil
+		} else {
+			r = new(Request)
+			err = c.getRequest(r)
+		}
+		if err != nil {
 			sendErrorPage(c, "404 Bad request", "Bad request", err.Error())
 			return
 		}
 		if dbgRq {
 			if verbose {
-				dbgRq.Printf("request from client %s: %s\n%s", c.RemoteAddr(), &r, r.Verbose())
+				dbgRq.Printf("request from client %s: %s\n%s", c.RemoteAddr(), r, r.Verbose())
 			} else {
-				dbgRq.Printf("request from client %s: %s\n", c.RemoteAddr(), &r)
+				dbgRq.Printf("request from client %s: %s\n", c.RemoteAddr(), r)
 			}
 		}
 
-		if isSelfURL(r.URL.HostPort) {
-			if err = c.serveSelfURL(&r); err != nil {
+		selfURL = isSelfURL(r.URL.HostPort)
+		if selfURL && !c.selfURLNeedAuth(r) {
+			if err = c.serveSelfURL(r); err != nil {
 				return
 			}
 			continue
 		}
 
-		if auth.required && !authed {
+		if auth.required && !c.authed {
 			if authCnt > 5 {
 				return
 			}
-			if err = Authenticate(c, &r); err != nil {
+			if err = Authenticate(c, r); err != nil {
 				if err == errAuthRequired {
 					authCnt++
 					continue
@@ -326,46 +403,25 @@ func (c *clientConn) serve() {
 					return
 				}
 			}
-			authed = true
+			c.authed = true
 		}
-
-	retry:
-		r.tryOnce()
-		if bool(debug) && r.isRetry() {
-			errl.Printf("%s retry request tryCnt=%d %v\n", c.RemoteAddr(), r.tryCnt, &r)
-		}
-		if sv, err = c.getServerConn(&r); err != nil {
-			// debug.Printf("Failed to get serverConn for %s %v\n", c.RemoteAddr(), r)
-			// Failed connection will send error page back to the client.
-			// For CONNECT, the client read buffer is released in copyClient2Server,
-			// so can't go back to getRequest.
-			if err == errPageSent && !r.isConnect {
-				continue
+		if selfURL {
+			if err = c.serveSelfURL(r); err != nil {
+				return
 			}
-			return
+			continue
 		}
 
 		if r.isConnect {
-			err = sv.doConnect(&r, c)
-			sv.Close()
-			if isErrRetry(err) {
-				// connection for CONNECT is not reused, no need to remove
-				if err = c.handleRetry(&r, sv, err); isErrRetry(err) {
-					goto retry
-				}
-			}
-			// debug.Printf("doConnect %s to %s done\n", c.RemoteAddr(), r.URL.HostPort)
+			// For CONNECT, the client read buffer is released in
+			// copyClient2Server, so can't go back to getRequest.
+			c.serveConnect(r)
 			return
 		}
+		sv = nil
 
-		if err = sv.doRequest(c, &r, &rp); err != nil {
-			c.removeServerConn(sv)
-			if isErrRetry(err) {
-				err = c.handleRetry(&r, sv, err)
-				if isErrRetry(err) {
-					goto retry
-				}
-			}
+	serve:
+		if err = c.serveRequest(r, sv, &rp); err != nil {
 			if err == errPageSent {
 				continue
 			}
@@ -379,6 +435,150 @@ func (c *clientConn) serve() {
 	}
 }
 
+// serveRequest sends request other than CONNECT to server and sends the
+// response back to client, retrying if possible. sv is the server connection
+// which r has been sent to in advance, nil if r is not sent.
+func (c *clientConn) serveRequest(r *Request, sv *serverConn, rp *Response) (err error) {
+	if sv != nil {
+		if c.serverConn[r.URL.HostPort] == sv {
+			goto recv
+		}
+		// Connection closed after previous response, send again.
+		sv = nil
+	}
+
+retry:
+	r.tryOnce()
+	if bool(debug) && r.isRetry() {
+		errl.Printf("%s retry request tryCnt=%d %v\n", c.RemoteAddr(), r.tryCnt, r)
+	}
+	if sv, err = c.getServerConn(r); err != nil {
+		// debug.Printf("Failed to get serverConn for %s %v\n", c.RemoteAddr(), r)
+		// Failed connection will send error page back to the client.
+		return
+	}
+	if err = sv.doRequest(c, r); err != nil {
+		goto fail
+	}
+
+recv:
+	if r.canPipeline() {
+		c.sendPipelined()
+		if c.serverConn[r.URL.HostPort] != sv {
+			// Connection closed upon error sending pipelined request.
+			goto retry
+		}
+	}
+	sv.pending--
+	if err = sv.doResponse(c, r, rp); err == nil {
+		return
+	}
+
+fail:
+	c.removeServerConn(sv)
+	if isErrRetry(err) {
+		if err = c.handleRetry(r, sv, err); isErrRetry(err) {
+			goto retry
+		}
+	}
+	return
+}
+
+// Max number of requests sent to server before receiving response of the
+// previous request.
+const maxPipeline = 8
+
+// pipelinedRequest is a request sent to server in advance.
+type pipelinedRequest struct {
+	r  *Request
+	sv *serverConn // nil if not sent
+}
+
+// sendPipelined reads pipelined requests in the client read buffer and sends
+// them to server before the previous response is received. Responses are
+// sent back to client in request order by serve. Request that can't be
+// pipelined is kept in c.readAhead and served after the pipeline is drained.
+//
+// Errors are not handled here as error page can't be sent before previous
+// responses. Request not sent will be sent by serveRequest.
+func (c *clientConn) sendPipelined() {
+	for c.readAhead == nil && len(c.pipeline) < maxPipeline && c.requestBuffered() {
+		r := new(Request)
+		if err := c.getRequest(r); err != nil {
+			c.readAhead, c.readAheadErr = r, err
+			return
+		}
+		if !r.canPipeline() || isSelfURL(r.URL.HostPort) || (auth.required && !c.authed) {
+			c.readAhead = r
+			return
+		}
+		if dbgRq {
+			dbgRq.Printf("pipelined request from client %s: %s\n", c.RemoteAddr(), r)
+		}
+
+		// Only send to existing connection, as failure in creating
+		// connection would send error page to client.
+		sv, ok := c.serverConn[r.URL.HostPort]
+		if ok && (sv.pending > 0 || !sv.mayBeClosed()) {
+			r.tryOnce()
+			if err := sv.doRequest(c, r); err != nil {
+				c.removeServerConn(sv)
+				sv = nil
+			}
+		} else {
+			sv = nil
+		}
+		c.pipeline = append(c.pipeline, pipelinedRequest{r, sv})
+	}
+}
+
+// requestBuffered returns true if the client read buffer contains a complete
+// request header. Reading partial request may block serving the previous
+// request.
+func (c *clientConn) requestBuffered() bool {
+	n := c.bufRd.Buffered()
+	if n == 0 {
+		return false
+	}
+	b, _ := c.bufRd.Peek(n)
+	return bytes.Contains(b, []byte("\n\r\n")) || bytes.Contains(b, []byte("\n\n"))
+}
+
+func (c *clientConn) releasePipeline() {
+	for _, pr := range c.pipeline {
+		pr.r.releaseBuf()
+	}
+	c.pipeline = nil
+	if c.readAhead != nil {
+		c.readAhead.releaseBuf()
+		c.readAhead = nil
+	}
+}
+
+// serveConnect handles CONNECT request, retrying with parent proxy if the
+// site is detected as blocked before any response is sent back to client.
+func (c *clientConn) serveConnect(r *Request) {
+	var sv *serverConn
+	var err error
+retry:
+	r.tryOnce()
+	if bool(debug) && r.isRetry() {
+		errl.Printf("%s retry request tryCnt=%d %v\n", c.RemoteAddr(), r.tryCnt, r)
+	}
+	if sv, err = c.getServerConn(r); err != nil {
+		return
+	}
+	err = sv.doConnect(r, c)
+	sv.Close()
+	if isErrRetry(err) {
+		// connection for CONNECT is not reused, no need to remove
+		if err = c.handleRetry(r, sv, err); isErrRetry(err) {
+			goto retry
+		}
+	}
+	// debug.Printf("doConnect %s to %s done\n", c.RemoteAddr(), r.URL.HostPort)
+}
+
 func genErrMsg(r *Request, sv *serverConn, what string) string {
 	if sv == nil {
 		return fmt.Sprintf("<p>HTTP Request <strong>%v</strong></p> <p>%s</p>", r, what)
@@ -486,6 +686,9 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	if err = parseResponse(sv, r, rp); err != nil {
 		return c.handleServerReadError(r, sv, err, "Parse response from server.")
 	}
+	if frs := rconfig().fakeResponses; sv.maybeFake() && len(frs) > 0 && sv.isFakeResponse(r, rp, frs) {
+		return c.handleBlockedRequest(r, errFakeResponse)
+	}
 	// After have received the first reponses from the server, we consider
 	// ther server as real instead of fake one caused by wrong DNS reply. So
 	// don't time out later.
@@ -506,6 +709,10 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	}
 	rp.releaseBuf()
 
+	if rp.switchProtocol() {
+		// Connection becomes a tunnel, handled by doRequest.
+		return
+	}
 	if rp.hasBody(r.Method) {
 		if err = sendBody(c, sv, nil, rp); err != nil {
 			// Non persistent connection will return nil upon successful response reading
@@ -539,6 +746,7 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 		} else {
 			sv.willCloseOn = time.Now().Add(rp.KeepAlive - time.Second)
 		}
+		sv.idle = true
 	} else {
 		c.removeServerConn(sv)
 	}
@@ -547,7 +755,8 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 
 func (c *clientConn) getServerConn(r *Request) (sv *serverConn, err error) {
 	sv, ok := c.serverConn[r.URL.HostPort]
-	if ok && sv.mayBeClosed() {
+	// Connection with pipelined request is not idle, so won't be closed.
+	if ok && sv.pending == 0 && sv.mayBeClosed() {
 		// debug.Printf("Connection to %s maybe closed\n", sv.url.HostPort)
 		c.removeServerConn(sv)
 		ok = false
@@ -564,18 +773,42 @@ func (c *clientConn) removeServerConn(sv *serverConn) {
 }
 
 func createctDirectConnection(url *URL, siteInfo *VisitCnt) (conn, error) {
-	to := dialTimeout
+	to := dialTimeout.get()
 	if siteInfo.OnceBlocked() && to >= defaultDialTimeout {
 		to = minDialTimeout
 	}
-	c, err := net.DialTimeout("tcp", url.HostPort, to)
+	if hostIsIP(url.Host) {
+		c, err := net.DialTimeout("tcp", url.HostPort, to)
+		if err != nil {
+			debug.Printf("error direct connect to: %s %v\n", url.HostPort, err)
+			return zeroConn, err
+		}
+		debug.Println("connected to", url.HostPort)
+		return conn{c, ctDirectConn, nil}, nil
+	}
+
+	ips, err := lookupHost(url.Host)
+	if err != nil {
+		debug.Printf("error resolving %s: %v\n", url.Host, err)
+		return zeroConn, err
+	}
+	if hasBogusIP(ips) {
+		debug.Printf("%s resolved to bogus IP %v\n", url.Host, ips)
+		markDNSPoisoned(url, siteInfo)
+		return zeroConn, errDNSPoisoned
+	}
+	c, err := dialHost(ips, url.Port, to)
 	if err != nil {
 		// Time out is very likely to be caused by GFW
 		debug.Printf("error direct connect to: %s %v\n", url.HostPort, err)
 		return zeroConn, err
 	}
+	if ip := remoteIP(c); ip != nil && config.TrustedDNS != "" && hasParentProxy &&
+		!siteInfo.userSpecified() && shouldCheckTrustedDNS(url.Host) {
+		go checkTrustedDNS(url, siteInfo, ip)
+	}
 	debug.Println("connected to", url.HostPort)
-	return conn{c, ctDirectConn}, nil
+	return conn{c, ctDirectConn, nil}, nil
 }
 
 func isErrTimeout(err error) bool {
@@ -589,77 +822,82 @@ func maybeBlocked(err error) bool {
 	return isErrTimeout(err) || isErrConnReset(err)
 }
 
-func createHttpProxyConnection(url *URL) (cn conn, err error) {
-	c, err := net.Dial("tcp", config.HttpParent)
-	if err != nil {
-		errl.Printf("can't connect to http parent proxy for %s: %v\n", url.HostPort, err)
-		return zeroConn, err
-	}
-	debug.Println("connected to:", url.HostPort, "via http parent proxy")
-	return conn{c, ctHttpProxyConn}, nil
+// httpParent is an HTTP parent proxy. authHeader is sent for basic
+// authentication if not nil.
+type httpParent struct {
+	ParentProxyStats
+	server     string
+	authHeader []byte
 }
 
-type parentProxyConnectionFunc func(*URL) (conn, error)
-
-var parentProxyCreator []parentProxyConnectionFunc
-var parentProxyFailCnt []int // initialized in checkConfig
+// httpConn is connection to http parent proxy. The parent is needed for
+// sending authentication header.
+type httpConn struct {
+	net.Conn
+	parent *httpParent
+}
 
-func callParentProxyCreateFunc(i int, url *URL) (srvconn conn, err error) {
-	const maxFailCnt = 30
-	srvconn, err = parentProxyCreator[i](url)
-	if err != nil {
-		if parentProxyFailCnt[i] < maxFailCnt && !networkBad() {
-			parentProxyFailCnt[i]++
+func init() {
+	RegisterParentProxy("http", func(server, userPasswd string) (ParentProxy, error) {
+		hp := newHttpParent(server)
+		if userPasswd != "" {
+			if !isUserPasswdValid(userPasswd) {
+				return nil, errors.New("username and password should be user:passwd")
+			}
+			hp.initAuth(userPasswd)
 		}
-		return
-	}
-	parentProxyFailCnt[i] = 0
-	return
+		return hp, nil
+	})
 }
 
-func createParentProxyConnection(url *URL) (srvconn conn, err error) {
-	const baseFailCnt = 9
-	var skipped []int
-	nproxy := len(parentProxyCreator)
+func newHttpParent(server string) *httpParent {
+	config.hasHttpParent = true
+	return &httpParent{server: server}
+}
 
-	proxyId := 0
-	if config.LoadBalance == loadBalanceHash {
-		proxyId = int(stringHash(url.Host) % uint64(nproxy))
-	}
+func (hp *httpParent) Name() string {
+	return "http " + hp.server
+}
 
-	for i := 0; i < nproxy; i++ {
-		proxyId = (proxyId + i) % nproxy
-		// skip failed server, but try it with some probability
-		failcnt := parentProxyFailCnt[proxyId]
-		if failcnt > 0 && rand.Intn(failcnt+baseFailCnt) != 0 {
-			skipped = append(skipped, proxyId)
-			continue
-		}
-		if srvconn, err = callParentProxyCreateFunc(proxyId, url); err == nil {
-			return
-		}
-	}
-	// last resort, try skipped one, not likely to succeed
-	for _, skippedId := range skipped {
-		if srvconn, err = callParentProxyCreateFunc(skippedId, url); err == nil {
-			return
-		}
-	}
-	if len(parentProxyCreator) != 0 {
-		return
+func (hp *httpParent) Close() error {
+	return nil
+}
+
+func (hp *httpParent) initAuth(userPasswd string) {
+	userPwd64 := base64.StdEncoding.EncodeToString([]byte(userPasswd))
+	hp.authHeader = []byte(headerProxyAuthorization + ": Basic " + userPwd64 + CRLF)
+}
+
+func (hp *httpParent) Dial(url *URL) (cn conn, err error) {
+	c, err := net.Dial("tcp", hp.server)
+	if err != nil {
+		errl.Printf("can't connect to http parent proxy %s for %s: %v\n", hp.server, url.HostPort, err)
+		return zeroConn, err
 	}
-	return zeroConn, errNoParentProxy
+	debug.Println("connected to:", url.HostPort, "via http parent proxy:", hp.server)
+	return conn{httpConn{c, hp}, ctHttpProxyConn, hp}, nil
 }
 
-func (c *clientConn) createConnection(r *Request, siteInfo *VisitCnt) (srvconn conn, err error) {
+// createConnection returns visited as true if site visit is already updated
+// and should not be updated by serverConn.
+func (c *clientConn) createConnection(r *Request, siteInfo *VisitCnt) (srvconn conn, visited bool, err error) {
 	var errMsg string
-	if config.AlwaysProxy {
+	if rconfig().AlwaysProxy {
 		if srvconn, err = createParentProxyConnection(r.URL); err == nil {
 			return
 		}
 		errMsg = genErrMsg(r, nil, "Parent proxy connection failed, always using parent proxy.")
 		goto fail
 	}
+	// Routed site always uses the specified parent proxies, no matter whether
+	// it's learned as direct or blocked.
+	if routeProxyIds(r.URL) != nil {
+		if srvconn, err = createParentProxyConnection(r.URL); err == nil {
+			return
+		}
+		errMsg = genErrMsg(r, nil, "Parent proxy connection failed, site has parent proxy route.")
+		goto fail
+	}
 	if siteInfo.AsBlocked() && hasParentProxy {
 		// In case of connection error to socks server, fallback to direct connection
 		if srvconn, err = createParentProxyConnection(r.URL); err == nil {
@@ -678,6 +916,13 @@ func (c *clientConn) createConnection(r *Request, siteInfo *VisitCnt) (srvconn c
 		}
 		errMsg = genErrMsg(r, nil, "Parent proxy and direct connection failed, maybe blocked site.")
 	} else {
+		if siteInfo.shouldRace() {
+			if srvconn, visited, err = raceConnection(r, siteInfo); err == nil {
+				return
+			}
+			errMsg = genErrMsg(r, nil, "Direct and parent proxy connection failed, maybe blocked site.")
+			goto fail
+		}
 		// In case of error on direction connection, try parent server
 		if srvconn, err = createctDirectConnection(r.URL, siteInfo); err == nil {
 			return
@@ -693,13 +938,13 @@ func (c *clientConn) createConnection(r *Request, siteInfo *VisitCnt) (srvconn c
 		// debug.Printf("type of err %v\n", reflect.TypeOf(err))
 		// GFW may cause dns lookup fail (net.DNSError),
 		// may also cause connection time out or reset (net.OpError)
-		if isDNSError(err) || maybeBlocked(err) {
+		if isDialErrBlocked(err) {
 			// Try to create connection by parent proxy
 			var socksErr error
 			if srvconn, socksErr = createParentProxyConnection(r.URL); socksErr == nil {
 				c.handleBlockedRequest(r, err)
 				debug.Println("direct connection failed, use parent proxy for", r)
-				return srvconn, nil
+				return srvconn, false, nil
 			}
 			errMsg = genErrMsg(r, nil, "Direct and parent proxy connection failed, maybe blocked site.")
 		} else {
@@ -709,17 +954,38 @@ func (c *clientConn) createConnection(r *Request, siteInfo *VisitCnt) (srvconn c
 	}
 
 fail:
-	sendErrorPage(c, "504 Connection failed", err.Error(), errMsg)
-	return zeroConn, errPageSent
+	c.sendConnFailure("504 Connection failed", err.Error(), errMsg)
+	return zeroConn, false, errPageSent
+}
+
+// sendConnFailure tells the client that connection to server can't be
+// created.
+func (c *clientConn) sendConnFailure(codeReason, h1, msg string) {
+	switch {
+	case c.socks:
+		sendSocksReply(c, socksRepHostUnreachable)
+	case c.transparent:
+		// client is not aware of the proxy, closing connection is all we can do
+	default:
+		sendErrorPage(c, codeReason, h1, msg)
+	}
 }
 
 func (c *clientConn) createServerConn(r *Request) (*serverConn, error) {
 	siteInfo := siteStat.GetVisitCnt(r.URL)
-	srvconn, err := c.createConnection(r, siteInfo)
+	if !r.isConnect {
+		if sv := connPool.get(r.URL, siteInfo); sv != nil {
+			sv.url = r.URL
+			c.serverConn[sv.url.HostPort] = sv
+			return sv, nil
+		}
+	}
+	srvconn, visited, err := c.createConnection(r, siteInfo)
 	if err != nil {
 		return nil, err
 	}
 	sv := newServerConn(srvconn, r.URL, siteInfo)
+	sv.visited = visited
 	if r.isConnect {
 		// Don't put connection for CONNECT method for reuse
 		return sv, nil
@@ -765,14 +1031,18 @@ func (sv *serverConn) initBuf() {
 	}
 }
 
-func (sv *serverConn) Close() error {
-	debug.Println("Closing server conn:", sv.url.HostPort)
+func (sv *serverConn) releaseBuf() {
 	sv.bufRd = nil
 	if sv.buf != nil {
 		// debug.Println("release server buffer")
 		httpBuf.Put(sv.buf)
 		sv.buf = nil
 	}
+}
+
+func (sv *serverConn) Close() error {
+	debug.Println("Closing server conn:", sv.url.HostPort)
+	sv.releaseBuf()
 	return sv.Conn.Close()
 }
 
@@ -796,7 +1066,7 @@ func unsetConnReadTimeout(cn net.Conn, msg string) {
 // In case it's not fake, this will unset timeout.
 func (sv *serverConn) setReadTimeout(msg string) {
 	if sv.maybeFake() {
-		to := readTimeout
+		to := readTimeout.get()
 		if sv.siteInfo.OnceBlocked() && to > defaultReadTimeout {
 			to = minReadTimeout
 		}
@@ -847,6 +1117,12 @@ func copyServer2Client(sv *serverConn, c *clientConn, r *Request) (err error) {
 		}
 	*/
 
+	if r.tlsHello && sv.maybeFake() {
+		if err = sv.checkTLSHandshake(r, c, buf); err != nil {
+			return
+		}
+	}
+
 	total := 0
 	const directThreshold = 4096
 	for {
@@ -884,6 +1160,47 @@ func copyServer2Client(sv *serverConn, c *clientConn, r *Request) (err error) {
 	return
 }
 
+// Stop checking if handshake messages are larger than this.
+const tlsMaxHandshakeLen = 64 * 1024
+
+// checkTLSHandshake reads server's handshake records until ServerHello and
+// certificate arrive, then sends them to client. Before that, EOF, reset or
+// timeout means the connection is interrupted by GFW, and the request can be
+// retried as nothing is sent to client. Completed handshake counts as direct
+// visit.
+func (sv *serverConn) checkTLSHandshake(r *Request, c *clientConn, buf []byte) (err error) {
+	var hs []byte
+	for {
+		sv.setReadTimeout("srv tls handshake")
+		var n int
+		if n, err = sv.Read(buf); err != nil {
+			if err == io.EOF || maybeBlocked(err) {
+				siteStat.TempBlocked(r.URL)
+				debug.Printf("TLS handshake with %s (sni %q) interrupted, err: %v retry\n",
+					r.URL.HostPort, r.sni, err)
+				return RetryError{err}
+			}
+			return
+		}
+		hs = append(hs, buf[:n]...)
+		done, perr := tlsServerHandshakeDone(hs)
+		if perr != nil {
+			debug.Printf("%s not responding TLS handshake: %v\n", r.URL.HostPort, perr)
+		} else if done {
+			sv.updateVisit()
+		} else if len(hs) < tlsMaxHandshakeLen {
+			continue
+		}
+		sv.unsetReadTimeout("srv tls handshake")
+		if _, err = c.Write(hs); err != nil {
+			return
+		}
+		r.state = rsRecvBody
+		sv.state = svSendRecvResponse
+		return
+	}
+}
+
 // write to server, store written data in request buffer if necessary
 type serverWriter struct {
 	rq *Request
@@ -925,7 +1242,8 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 
 	var n int
 
-	if r.isRetry() {
+	// For upgraded connection, request has been sent before the tunnel.
+	if r.isConnect && r.isRetry() {
 		if debug {
 			debug.Printf("cli(%s)->srv(%s) retry request %d bytes of buffered body\n",
 				c.RemoteAddr(), r.URL.HostPort, len(r.rawBody()))
@@ -953,7 +1271,8 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 	}
 
 	var start time.Time
-	if config.DetectSSLErr {
+	detectSSLErr := rconfig().DetectSSLErr
+	if detectSSLErr {
 		start = time.Now()
 	}
 	buf := connectBuf.Get()
@@ -971,7 +1290,7 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 			deadlineIsSet = false
 		}
 		if n, err = c.Read(buf); err != nil {
-			if config.DetectSSLErr && (isErrConnReset(err) || err == io.EOF) && sv.maybeSSLErr(start) {
+			if detectSSLErr && (isErrConnReset(err) || err == io.EOF) && sv.maybeSSLErr(start) {
 				debug.Println("client connection closed very soon, taken as SSL error:", r)
 				siteStat.TempBlocked(r.URL)
 			} else if isErrTimeout(err) && !srvStopped.hasNotified() {
@@ -1002,10 +1321,26 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 
 var connEstablished = []byte("HTTP/1.1 200 Tunnel established\r\n\r\n")
 
+func (c *clientConn) sendConnEstablished() (err error) {
+	switch {
+	case c.socks:
+		err = sendSocksReply(c, socksRepSucceeded)
+	case c.transparent:
+		// client is not aware of the proxy, nothing to send
+	default:
+		_, err = c.Write(connEstablished)
+	}
+	return
+}
+
 // Do HTTP CONNECT
 func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 	r.state = rsCreated
 
+	// HTTP client understands http parent's reply, so pass it to the client.
+	// Other clients need to get reply from COW.
+	httpClient := !c.socks && !c.transparent
+	var buffered []byte
 	if sv.connType == ctHttpProxyConn {
 		// debug.Printf("%s Sending CONNECT request to http proxy server\n", c.RemoteAddr())
 		if err = sv.sendHTTPProxyRequest(r, c); err != nil {
@@ -1015,31 +1350,86 @@ func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 			}
 			return err
 		}
-	} else if !r.isRetry() {
+		if !httpClient {
+			if buffered, err = sv.recvHTTPProxyConnectReply(r, c); err != nil {
+				if c.socks && !r.isRetry() {
+					sendSocksReply(c, socksRepGeneralFailure)
+				}
+				return err
+			}
+		}
+	}
+	if !r.isRetry() && (sv.connType != ctHttpProxyConn || !httpClient) {
 		// debug.Printf("send connection confirmation to %s->%s\n", c.RemoteAddr(), r.URL.HostPort)
-		if _, err = c.Write(connEstablished); err != nil {
+		if err = c.sendConnEstablished(); err != nil {
 			if debug {
 				debug.Printf("%v Error sending 200 Connecion established: %v\n", c.RemoteAddr(), err)
 			}
 			return err
 		}
 	}
+	if len(buffered) > 0 {
+		if _, err = c.Write(buffered); err != nil {
+			return err
+		}
+	}
+	if !r.isRetry() && sv.maybeFake() && c.bufRd != nil && tlsPort[r.URL.Port] {
+		c.peekClientHello(r)
+	}
 
+	return sv.tunnel(r, c)
+}
+
+// Time to wait for client to send ClientHello after connection established.
+// Protocols where server speaks first are delayed by this time, so only
+// tunnels to well known TLS ports are checked.
+const tlsClientHelloTimeout = time.Second
+
+var tlsPort = map[string]bool{
+	"443":  true, // https
+	"465":  true, // smtps
+	"853":  true, // dns over tls
+	"993":  true, // imaps
+	"995":  true, // pop3s
+	"8443": true,
+}
+
+// peekClientHello checks whether client starts the tunnel with TLS
+// ClientHello, data is kept in the read buffer.
+func (c *clientConn) peekClientHello(r *Request) {
+	setConnReadTimeout(c, tlsClientHelloTimeout, "peek ClientHello")
+	defer unsetConnReadTimeout(c, "peek ClientHello")
+	b, err := c.bufRd.Peek(1)
+	if err != nil || b[0] != tlsRecordHandshake {
+		return
+	}
+	r.tlsHello = true
+	r.sni = c.sniffTLSServerName()
+	if debug {
+		debug.Printf("%s TLS ClientHello for %s sni %q\n", c.RemoteAddr(), r.URL.HostPort, r.sni)
+	}
+}
+
+// tunnel copies data between client and server until either side closes the
+// connection. Returns RetryError if the site is detected as blocked before
+// any data is sent back to the client.
+func (sv *serverConn) tunnel(r *Request, c *clientConn) (err error) {
 	var cli2srvErr error
 	done := make(chan byte, 1)
 	srvStopped := newNotification()
 	go func() {
-		// debug.Printf("doConnect: cli(%s)->srv(%s)\n", c.RemoteAddr(), r.URL.HostPort)
+		// debug.Printf("tunnel: cli(%s)->srv(%s)\n", c.RemoteAddr(), r.URL.HostPort)
 		cli2srvErr = copyClient2Server(c, sv, r, srvStopped, done)
 		sv.Close() // close sv to force read from server in copyServer2Client return
 	}()
 
-	// debug.Printf("doConnect: srv(%s)->cli(%s)\n", r.URL.HostPort, c.RemoteAddr())
+	// debug.Printf("tunnel: srv(%s)->cli(%s)\n", r.URL.HostPort, c.RemoteAddr())
 	err = copyServer2Client(sv, c, r)
-	if isErrRetry(err) {
+	if isErrRetry(err) && r.responseNotSent() {
+		// client connection is needed for retry
 		srvStopped.notify()
 		<-done
-		// debug.Printf("doConnect: cli(%s)->srv(%s) stopped\n", c.RemoteAddr(), r.URL.HostPort)
+		// debug.Printf("tunnel: cli(%s)->srv(%s) stopped\n", c.RemoteAddr(), r.URL.HostPort)
 	} else {
 		// close client connection to force read from client in copyClient2Server return
 		c.Conn.Close()
@@ -1056,8 +1446,8 @@ func (sv *serverConn) sendHTTPProxyRequest(r *Request, c *clientConn) (err error
 			"sending proxy request line to http parent")
 	}
 	// Add authorization header for parent http proxy
-	if config.httpAuthHeader != nil {
-		if _, err = sv.Write(config.httpAuthHeader); err != nil {
+	if hp := sv.Conn.(httpConn).parent; hp.authHeader != nil {
+		if _, err = sv.Write(hp.authHeader); err != nil {
 			return c.handleServerWriteError(r, sv, err,
 				"sending proxy authorization header to http parent")
 		}
@@ -1074,6 +1464,31 @@ func (sv *serverConn) sendHTTPProxyRequest(r *Request, c *clientConn) (err error
 	return
 }
 
+// recvHTTPProxyConnectReply reads http parent proxy's response to CONNECT
+// request. Returns data already sent by the server after the response.
+func (sv *serverConn) recvHTTPProxyConnectReply(r *Request, c *clientConn) (buffered []byte, err error) {
+	var rp Response
+	sv.initBuf()
+	defer func() {
+		rp.releaseBuf()
+		sv.releaseBuf()
+	}()
+
+	if err = parseResponse(sv, r, &rp); err != nil {
+		errl.Printf("%s reading http parent reply for %v: %v\n", c.RemoteAddr(), r, err)
+		return
+	}
+	if rp.Status != 200 {
+		errl.Printf("%s http parent reply %s for %v\n", c.RemoteAddr(), &rp, r)
+		return nil, errors.New("http parent CONNECT failed: " + rp.String())
+	}
+	if n := sv.bufRd.Buffered(); n > 0 {
+		b, _ := sv.bufRd.Peek(n)
+		buffered = append(buffered, b...)
+	}
+	return
+}
+
 func (sv *serverConn) sendRequest(r *Request, c *clientConn) (err error) {
 	// Send request to the server
 	if sv.connType == ctHttpProxyConn {
@@ -1090,9 +1505,10 @@ func (sv *serverConn) sendRequest(r *Request, c *clientConn) (err error) {
 	return
 }
 
-// Do HTTP request other that CONNECT
-func (sv *serverConn) doRequest(c *clientConn, r *Request, rp *Response) (err error) {
+// Send HTTP request other that CONNECT, including the request body.
+func (sv *serverConn) doRequest(c *clientConn, r *Request) (err error) {
 	r.state = rsCreated
+	sv.idle = false
 	if err = sv.sendRequest(r, c); err != nil {
 		return
 	}
@@ -1117,13 +1533,42 @@ func (sv *serverConn) doRequest(c *clientConn, r *Request, rp *Response) (err er
 		}
 	}
 	r.state = rsSent
+	sv.pending++
+	return
+}
+
+// Receive response for request sent by doRequest.
+func (sv *serverConn) doResponse(c *clientConn, r *Request, rp *Response) (err error) {
 	err = c.readResponse(sv, r, rp)
 	if err == nil {
 		sv.updateVisit()
+		if rp.switchProtocol() {
+			sv.doUpgrade(r, c)
+			// Close both connections after the tunnel is done.
+			return errShouldClose
+		}
 	}
 	return
 }
 
+// doUpgrade tunnels data after the server switches protocol, e.g. WebSocket.
+// Blocked site is detected while reading response for the upgrade request, so
+// there's no retry here.
+func (sv *serverConn) doUpgrade(r *Request, c *clientConn) {
+	if debug {
+		debug.Printf("%s %v switched protocol to %s\n", c.RemoteAddr(), r, r.Upgrade)
+	}
+	// Server may send data right after the response.
+	if n := sv.bufRd.Buffered(); n > 0 {
+		b, _ := sv.bufRd.Peek(n)
+		if _, err := c.Write(b); err != nil {
+			return
+		}
+	}
+	sv.releaseBuf()
+	sv.tunnel(r, c)
+}
+
 // Send response body if header specifies content length
 func sendBodyWithContLen(r *bufio.Reader, w io.Writer, contLen int) (err error) {
 	// debug.Println("Sending body with content length", contLen)
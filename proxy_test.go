@@ -3,8 +3,12 @@ package main
 import (
 	"bytes"
 	"github.com/cyfdecyf/bufio"
+	"io"
+	"net"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSendBodyChunked(t *testing.T) {
@@ -46,3 +50,135 @@ func TestSendBodyChunked(t *testing.T) {
 		}
 	}
 }
+
+// readTestResponse reads a response with content length and returns the body.
+func readTestResponse(r *bufio.Reader) (body string, err error) {
+	contLen := 0
+	for {
+		s, err := r.ReadSlice('\n')
+		if err != nil {
+			return "", err
+		}
+		line := strings.ToLower(strings.TrimSpace(string(s)))
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "content-length:") {
+			contLen, _ = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+		}
+	}
+	b := make([]byte, contLen)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func TestPipeline(t *testing.T) {
+	paths := []string{"/a", "/b", "/c"}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Read all requests before sending any response, this will time out
+		// if requests are not pipelined.
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		rd := bufio.NewReader(conn)
+		var got []string
+		for len(got) < len(paths) {
+			s, err := rd.ReadSlice('\n')
+			if err != nil {
+				t.Error("server reading request:", err)
+				return
+			}
+			if f := strings.Fields(string(s)); len(f) == 3 {
+				got = append(got, f[1])
+			}
+		}
+		for _, path := range got {
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: " +
+				strconv.Itoa(len(path)) + "\r\n\r\n" + path))
+		}
+	}()
+
+	// other tests may have enabled authentication
+	authRequired := auth.required
+	auth.required = false
+	defer func() {
+		auth.required = authRequired
+	}()
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	c := newClientConn(srv, nil)
+	go c.serve()
+
+	var req bytes.Buffer
+	for _, path := range paths {
+		req.WriteString("GET http://" + ln.Addr().String() + path + " HTTP/1.1\r\nConnection: keep-alive\r\n\r\n")
+	}
+	go cli.Write(req.Bytes())
+
+	cli.SetReadDeadline(time.Now().Add(3 * time.Second))
+	rd := bufio.NewReader(cli)
+	for _, path := range paths {
+		body, err := readTestResponse(rd)
+		if err != nil {
+			t.Fatalf("reading response for %s: %v\n", path, err)
+		}
+		if body != path {
+			t.Errorf("response out of order, want %s, got %s\n", path, body)
+		}
+	}
+}
+
+func TestSelfURLNeedAuth(t *testing.T) {
+	authRequired := auth.required
+	auth.required = true
+	defer func() {
+		auth.required = authRequired
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	lc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer lc.Close()
+	loopback := newClientConn(lc, nil)
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	remote := newClientConn(srv, nil)
+
+	stat := &Request{URL: &URL{Path: "/stat"}}
+	pac := &Request{URL: &URL{Path: "/pac"}}
+	if remote.selfURLNeedAuth(pac) {
+		t.Error("pac should not need auth")
+	}
+	if !remote.selfURLNeedAuth(stat) {
+		t.Error("stat from remote client should need auth")
+	}
+	if loopback.selfURLNeedAuth(stat) {
+		t.Error("stat from loopback client should not need auth")
+	}
+	remote.authed = true
+	if remote.selfURLNeedAuth(stat) {
+		t.Error("stat from authed client should not need auth")
+	}
+	auth.required = false
+	remote.authed = false
+	if remote.selfURLNeedAuth(stat) {
+		t.Error("stat should not need auth if auth not required")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Domain of a host is the public suffix plus one more label, so that
+// foo.github.io and bar.github.io are different sites. Public suffix rules
+// come from the Public Suffix List embedded in publicsuffix_list.go, which
+// can be overridden by file public_suffix_list.dat in config directory.
+
+// Flags of public suffix rules. Wildcard rule "*.ck" is stored as "ck" with
+// pslWildcard, exception rule "!www.ck" as "www.ck" with pslException.
+const (
+	pslNormal    = 1
+	pslWildcard  = 2
+	pslException = 4
+)
+
+var publicSuffixRules map[string]uint8
+
+func init() {
+	publicSuffixRules = parsePublicSuffixList(publicSuffixList)
+}
+
+func parsePublicSuffixList(lst string) map[string]uint8 {
+	rules := make(map[string]uint8)
+	for _, line := range strings.Split(lst, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.HasPrefix(f[0], "//") {
+			continue
+		}
+		s := strings.ToLower(f[0])
+		switch {
+		case strings.HasPrefix(s, "*."):
+			rules[s[2:]] |= pslWildcard
+		case s[0] == '!':
+			// exception for top level domain makes no sense
+			if strings.IndexByte(s, '.') != -1 {
+				rules[s[1:]] |= pslException
+			}
+		default:
+			rules[s] |= pslNormal
+		}
+	}
+	return rules
+}
+
+// loadPublicSuffixList replaces embedded list with the one in fpath if it
+// exists.
+func loadPublicSuffixList(fpath string) {
+	if exists, err := isFileExists(fpath); !exists {
+		if err != nil {
+			errl.Println("Error loading public suffix list:", err)
+		}
+		return
+	}
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		errl.Println("Error loading public suffix list:", err)
+		return
+	}
+	rules := parsePublicSuffixList(string(b))
+	if len(rules) == 0 {
+		errl.Printf("No rule in public suffix list %s, use embedded list\n", fpath)
+		return
+	}
+	debug.Printf("Loaded %d public suffix rules from %s\n", len(rules), fpath)
+	publicSuffixRules = rules
+}
+
+// publicSuffix returns the public suffix of lower case host. The longest
+// matching rule prevails, exception rule takes precedence. Last label is
+// taken as public suffix if no rule matches.
+func publicSuffix(host string) string {
+	start := strings.LastIndexByte(host, '.') + 1
+	ps := host[start:]
+	parent := ""
+	for {
+		s := host[start:]
+		flag := publicSuffixRules[s]
+		if flag&pslException != 0 {
+			return parent
+		}
+		if flag&pslNormal != 0 || (parent != "" && publicSuffixRules[parent]&pslWildcard != 0) {
+			ps = s
+		}
+		if start == 0 {
+			return ps
+		}
+		parent = s
+		start = strings.LastIndexByte(host[:start-1], '.') + 1
+	}
+}
+
+// genPACPublicSuffix generates JavaScript object properties of public suffix
+// rules needed in PAC to get domain of hosts under the given domains, which
+// are rules being suffix of some domain or under some domain.
+func genPACPublicSuffix(domains []string) string {
+	dmSet := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		dmSet[d] = true
+	}
+	needed := make(map[string]bool)
+	for r := range publicSuffixRules {
+		for s := r; ; {
+			if dmSet[s] {
+				needed[r] = true
+				break
+			}
+			i := strings.IndexByte(s, '.')
+			if i == -1 {
+				break
+			}
+			s = s[i+1:]
+		}
+	}
+	for _, d := range domains {
+		for s := d; ; {
+			if _, ok := publicSuffixRules[s]; ok {
+				needed[s] = true
+			}
+			i := strings.IndexByte(s, '.')
+			if i == -1 {
+				break
+			}
+			s = s[i+1:]
+		}
+	}
+
+	keys := make([]string, 0, len(needed))
+	for k := range needed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = fmt.Sprintf("\t\"%s\": %d", k, publicSuffixRules[k])
+	}
+	return strings.Join(lines, ",\n")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPublicSuffix(t *testing.T) {
+	rules := publicSuffixRules
+	defer func() { publicSuffixRules = rules }()
+	publicSuffixRules = parsePublicSuffixList(`
+// comment
+com
+*.ck
+!www.ck
+jp
+*.kawasaki.jp
+!city.kawasaki.jp
+`)
+
+	var testData = []struct {
+		host   string
+		suffix string
+	}{
+		{"example.com", "com"},
+		{"www.example.com", "com"},
+		{"foo.ck", "foo.ck"},
+		{"a.foo.ck", "foo.ck"},
+		{"www.ck", "ck"},
+		{"a.www.ck", "ck"},
+		{"a.b.kawasaki.jp", "b.kawasaki.jp"},
+		{"a.city.kawasaki.jp", "kawasaki.jp"},
+		{"kawasaki.jp", "jp"},
+		{"foo.unknown", "unknown"},
+	}
+	for _, td := range testData {
+		if ps := publicSuffix(td.host); ps != td.suffix {
+			t.Errorf("%s public suffix should be %s, got %s\n", td.host, td.suffix, ps)
+		}
+	}
+	if dm := host2Domain("a.b.foo.ck"); dm != "b.foo.ck" {
+		t.Error("a.b.foo.ck domain should be b.foo.ck, got", dm)
+	}
+	if dm := host2Domain("a.www.ck"); dm != "www.ck" {
+		t.Error("a.www.ck domain should be www.ck, got", dm)
+	}
+}
+
+func TestGenPACPublicSuffix(t *testing.T) {
+	rules := publicSuffixRules
+	defer func() { publicSuffixRules = rules }()
+	publicSuffixRules = parsePublicSuffixList(`
+com
+net
+io
+github.io
+blogspot.com
+*.ck
+!www.ck
+`)
+
+	js := genPACPublicSuffix([]string{"google.com", "www.ck", "io"})
+	// blogspot.com and net are not related to the domains
+	expected := `	"ck": 2,
+	"com": 1,
+	"github.io": 1,
+	"io": 1,
+	"www.ck": 4`
+	if js != expected {
+		t.Errorf("PAC public suffix wrong, got\n%s\nexpected\n%s\n", js, expected)
+	}
+}
+
+func TestBuiltinListOldDomain(t *testing.T) {
+	// builtin direct site sinaapp.com is a public suffix in private section
+	if dm := host2Domain("foo.sinaapp.com"); dm != "foo.sinaapp.com" {
+		t.Error("foo.sinaapp.com domain should be foo.sinaapp.com, got", dm)
+	}
+	ss := newSiteStat()
+	ss.loadBuiltinList()
+	url, _ := ParseRequestURI("foo.sinaapp.com")
+	if !ss.GetVisitCnt(url).AlwaysDirect() {
+		t.Error("foo.sinaapp.com should match builtin direct site sinaapp.com")
+	}
+}
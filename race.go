@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+)
+
+// Racing direct and parent proxy connection for sites with unknown or once
+// blocked state, similar to happy eyeballs. Direct connection is started
+// first, if it has not finished after raceDelay, parent proxy
+// connection is started and the first successful one is used. This avoids
+// waiting for dial timeout on newly blocked sites.
+//
+// If parent proxy wins, direct connection keeps going in background and its
+// result is fed to site stat: blocked error counts as a blocked visit. A
+// late direct connection is closed without counting as direct visit, as
+// COW only counts direct visit after getting response.
+
+type dialResult struct {
+	cn  conn
+	err error
+}
+
+func (vc *VisitCnt) shouldRace() bool {
+	if rconfig().RaceDelay == 0 || !hasParentProxy || vc.userSpecified() {
+		return false
+	}
+	return (vc.Direct == 0 && vc.Blocked == 0) || vc.OnceBlocked()
+}
+
+func dialDirect(url *URL, siteInfo *VisitCnt) chan dialResult {
+	ch := make(chan dialResult, 1)
+	go func() {
+		cn, err := createctDirectConnection(url, siteInfo)
+		ch <- dialResult{cn, err}
+	}()
+	return ch
+}
+
+func dialParentProxy(url *URL) chan dialResult {
+	ch := make(chan dialResult, 1)
+	go func() {
+		cn, err := createParentProxyConnection(url)
+		ch <- dialResult{cn, err}
+	}()
+	return ch
+}
+
+// closeRaceLoser closes connection that's not used. ch maybe nil.
+func closeRaceLoser(ch chan dialResult) {
+	if ch == nil {
+		return
+	}
+	go func() {
+		if res := <-ch; res.err == nil {
+			res.cn.Close()
+		}
+	}()
+}
+
+func raceDirectResult(url *URL, siteInfo *VisitCnt, ch chan dialResult) {
+	res := <-ch
+	if res.err == nil {
+		debug.Println("raced direct connection finished after parent proxy:", url.HostPort)
+		res.cn.Close()
+		return
+	}
+	if isDialErrBlocked(res.err) {
+		debug.Printf("raced direct connection to %s failed: %v\n", url.HostPort, res.err)
+		siteStat.TempBlocked(url)
+		siteInfo.BlockedVisit()
+	}
+}
+
+// raceConnection returns the first successful connection. visited is true if
+// parent proxy connection is returned before direct connection finishes,
+// site visit is updated in background for this case. If direct connection
+// fails with error not caused by blocking, the error is returned without
+// waiting for parent proxy.
+func raceConnection(r *Request, siteInfo *VisitCnt) (srvconn conn, visited bool, err error) {
+	directCh := dialDirect(r.URL, siteInfo)
+	timer := time.NewTimer(rconfig().RaceDelay)
+	defer timer.Stop()
+
+	var parentCh chan dialResult
+	var parentErr error
+	for {
+		select {
+		case <-timer.C:
+			debug.Println("direct connection slow, racing with parent proxy for", r)
+			parentCh = dialParentProxy(r.URL)
+		case res := <-directCh:
+			if res.err == nil {
+				closeRaceLoser(parentCh)
+				return res.cn, false, nil
+			}
+			if !isDialErrBlocked(res.err) {
+				closeRaceLoser(parentCh)
+				return zeroConn, false, res.err
+			}
+			siteStat.TempBlocked(r.URL)
+			if parentErr != nil {
+				return zeroConn, false, parentErr
+			}
+			if parentCh == nil {
+				parentCh = dialParentProxy(r.URL)
+			}
+			pres := <-parentCh
+			if pres.err == nil {
+				debug.Println("direct connection failed, use parent proxy for", r)
+			}
+			return pres.cn, false, pres.err
+		case res := <-parentCh:
+			if res.err != nil {
+				// wait for direct connection
+				parentCh = nil
+				parentErr = res.err
+				continue
+			}
+			debug.Println("parent proxy connected first for", r)
+			go raceDirectResult(r.URL, siteInfo, directCh)
+			return res.cn, true, nil
+		}
+	}
+}
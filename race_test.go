@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShouldRace(t *testing.T) {
+	restore := setTestConfig(func(rc *reloadableConfig) { rc.RaceDelay = 300 * time.Millisecond })
+	hasParentProxy = true
+	defer func() {
+		restore()
+		hasParentProxy = false
+	}()
+
+	var testData = []struct {
+		vc   *VisitCnt
+		race bool
+	}{
+		{newVisitCnt(0, 0), true},
+		{newVisitCnt(0, 2), true},
+		{newVisitCnt(3, 0), false},
+		{newVisitCnt(userCnt, 0), false},
+		{newVisitCnt(0, userCnt), false},
+	}
+	for i, td := range testData {
+		if td.vc.shouldRace() != td.race {
+			t.Errorf("%d: %+v should race %v\n", i, td.vc, td.race)
+		}
+	}
+	defer setTestConfig(func(rc *reloadableConfig) { rc.RaceDelay = 0 })()
+	if newVisitCnt(0, 0).shouldRace() {
+		t.Error("should not race when raceDelay is 0")
+	}
+}
+
+func TestRaceConnectionDirectFirst(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+
+	defer setTestConfig(func(rc *reloadableConfig) { rc.RaceDelay = time.Second })()
+	parentCalled := make(chan bool, 1)
+	defer initTestParentProxy(func(*URL) (conn, error) {
+		parentCalled <- true
+		return zeroConn, errNoParentProxy
+	})()
+
+	url, _ := ParseRequestURI(ln.Addr().String())
+	r := &Request{URL: url}
+	cn, visited, err := raceConnection(r, newVisitCnt(0, 0))
+	if err != nil {
+		t.Fatal("race connection:", err)
+	}
+	cn.Close()
+	if cn.connType != ctDirectConn || visited {
+		t.Errorf("direct connection should win, got %s visited %v\n", ctName[cn.connType], visited)
+	}
+	select {
+	case <-parentCalled:
+		t.Error("parent proxy should not be tried when direct connection is fast")
+	default:
+	}
+}
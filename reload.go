@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Blocked and direct lists, GFWList files and some options in config file
+// are reloaded upon SIGHUP or when the files are modified. Existing
+// connections are not affected. Changes to other options, such as listen
+// address, parent proxies, dnsServer and bogusIP, and changes to route file
+// and public suffix list take effect after restart.
+//
+// Reloadable options are published as an immutable snapshot, which is got
+// by rconfig, so they can be read without locking. Reloading starts from
+// options in effect at start up, so an option removed from config file
+// keeps its start up value. List options (gfwList, fakeResponse) are
+// replaced by the ones in config file.
+
+const reloadCheckInterval = 5 * time.Second
+
+// reloadableConfig contains options that can be changed without restart.
+// Should not be modified once published.
+type reloadableConfig struct {
+	AlwaysProxy   bool
+	DetectSSLErr  bool
+	DialTimeout   time.Duration
+	ReadTimeout   time.Duration
+	RaceDelay     time.Duration
+	GFWList       []string
+	fakeResponses []*fakeResponse
+}
+
+func parseReloadBool(val, opt string) (bool, error) {
+	switch val {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errors.New(opt + " should be true or false")
+}
+
+func parseReloadDuration(val, opt string) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errors.New(opt + " " + err.Error())
+	}
+	return d, nil
+}
+
+var (
+	reloadable    atomic.Value // *reloadableConfig
+	startupConfig = &reloadableConfig{
+		DialTimeout: defaultDialTimeout,
+		ReadTimeout: defaultReadTimeout,
+	}
+)
+
+func init() {
+	reloadable.Store(startupConfig)
+}
+
+// rconfig returns current reloadable options.
+func rconfig() *reloadableConfig {
+	return reloadable.Load().(*reloadableConfig)
+}
+
+// initReloadableConfig publishes reloadable options parsed from config
+// file and command line upon start up.
+func initReloadableConfig() {
+	startupConfig = &reloadableConfig{
+		AlwaysProxy:   config.AlwaysProxy,
+		DetectSSLErr:  config.DetectSSLErr,
+		DialTimeout:   config.DialTimeout,
+		ReadTimeout:   config.ReadTimeout,
+		RaceDelay:     config.RaceDelay,
+		GFWList:       config.GFWList,
+		fakeResponses: fakeResponses,
+	}
+	reloadable.Store(startupConfig)
+}
+
+// parseReloadableConfig parses reloadable options in config file, other
+// options are ignored. Options not in config file get start up value.
+func parseReloadableConfig(path string) (rc *reloadableConfig, err error) {
+	rc = &reloadableConfig{
+		AlwaysProxy:  startupConfig.AlwaysProxy,
+		DetectSSLErr: startupConfig.DetectSSLErr,
+		DialTimeout:  startupConfig.DialTimeout,
+		ReadTimeout:  startupConfig.ReadTimeout,
+		RaceDelay:    startupConfig.RaceDelay,
+	}
+	err = readConfig(path, func(key, val string) (err error) {
+		switch key {
+		case "alwaysProxy":
+			rc.AlwaysProxy, err = parseReloadBool(val, key)
+		case "detectSSLErr":
+			rc.DetectSSLErr, err = parseReloadBool(val, key)
+		case "dialTimeout":
+			rc.DialTimeout, err = parseReloadDuration(val, key)
+		case "readTimeout":
+			rc.ReadTimeout, err = parseReloadDuration(val, key)
+		case "raceDelay":
+			rc.RaceDelay, err = parseReloadDuration(val, key)
+		case "gfwList":
+			rc.GFWList = append(rc.GFWList, expandTilde(val))
+		case "fakeResponse":
+			var fr *fakeResponse
+			if fr, err = parseFakeResponse(val); err == nil {
+				rc.fakeResponses = append(rc.fakeResponses, fr)
+			}
+		}
+		return
+	})
+	if os.IsNotExist(err) {
+		return rc, nil
+	}
+	return
+}
+
+// apply publishes rc, rc should not be modified afterwards.
+func (rc *reloadableConfig) apply() {
+	old := rconfig()
+	reloadable.Store(rc)
+	if old.DialTimeout != rc.DialTimeout {
+		dialTimeout.set(rc.DialTimeout)
+	}
+	if old.ReadTimeout != rc.ReadTimeout {
+		readTimeout.set(rc.ReadTimeout)
+	}
+}
+
+var reloadLock sync.Mutex
+
+// reload applies changes in config file and site lists. Config is kept
+// unchanged if there's any error in config file.
+func reload() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if rc, err := parseReloadableConfig(config.RcFile); err != nil {
+		errl.Println("Error reloading config, keep current options:", err)
+	} else {
+		rc.apply()
+	}
+	siteStat.reloadUserList()
+	updatePACRules()
+	updatePACDirectList()
+	info.Println("config and site lists reloaded")
+}
+
+// reloadFiles returns files whose change triggers reload.
+func reloadFiles() []string {
+	files := []string{expandTilde(config.RcFile), dsFile.alwaysBlocked, dsFile.alwaysDirect}
+	return append(files, rconfig().GFWList...)
+}
+
+// runReloadWatcher checks modification time of config file and site lists
+// periodically and reloads upon change.
+func runReloadWatcher() {
+	mtime := make(map[string]time.Time)
+	modified := func() (changed bool) {
+		for _, f := range reloadFiles() {
+			var t time.Time // zero time for not existing file
+			if fi, err := os.Stat(f); err == nil {
+				t = fi.ModTime()
+			}
+			if old, ok := mtime[f]; ok && !old.Equal(t) {
+				debug.Println("reload:", f, "modified")
+				changed = true
+			}
+			mtime[f] = t
+		}
+		return
+	}
+	modified()
+	for {
+		time.Sleep(reloadCheckInterval)
+		if modified() {
+			reload()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// setTestConfig publishes reloadable options changed by fn, returns a
+// function to restore.
+func setTestConfig(fn func(rc *reloadableConfig)) func() {
+	old := rconfig()
+	rc := *old
+	fn(&rc)
+	reloadable.Store(&rc)
+	return func() {
+		reloadable.Store(old)
+	}
+}
+
+func TestParseReloadableConfig(t *testing.T) {
+	startup := startupConfig
+	startupConfig = &reloadableConfig{
+		DialTimeout: 7 * time.Second,
+		ReadTimeout: defaultReadTimeout,
+		RaceDelay:   time.Second,
+		GFWList:     []string{"/tmp/startup.txt"},
+	}
+	defer func() { startupConfig = startup }()
+
+	dir, err := ioutil.TempDir("", "cow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rcFile := path.Join(dir, "rc")
+
+	rc := `# comment
+listen = 127.0.0.1:7777
+alwaysProxy = true
+readTimeout = 10s
+gfwList = /tmp/gfwlist.txt
+fakeResponse = status:302 location:http://block.example/
+`
+	if err := ioutil.WriteFile(rcFile, []byte(rc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseReloadableConfig(rcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.AlwaysProxy || c.DetectSSLErr {
+		t.Error("bool option parse error, got", c.AlwaysProxy, c.DetectSSLErr)
+	}
+	if c.ReadTimeout != 10*time.Second {
+		t.Error("timeout option parse error, got", c.ReadTimeout)
+	}
+	if c.DialTimeout != 7*time.Second || c.RaceDelay != time.Second {
+		t.Error("option not in config file should keep start up value, got", c.DialTimeout, c.RaceDelay)
+	}
+	if len(c.GFWList) != 1 || c.GFWList[0] != "/tmp/gfwlist.txt" ||
+		len(c.fakeResponses) != 1 || c.fakeResponses[0].status != 302 {
+		t.Error("list option parse error, got", c.GFWList, c.fakeResponses)
+	}
+
+	for _, bad := range []string{"alwaysProxy = yes\n", "raceDelay = 1\n", "fakeResponse = foo\n", "alwaysProxy\n"} {
+		ioutil.WriteFile(rcFile, []byte(bad), 0644)
+		if _, err := parseReloadableConfig(rcFile); err == nil {
+			t.Errorf("%q should report error\n", bad)
+		}
+	}
+
+	if c, err = parseReloadableConfig(path.Join(dir, "notexist")); err != nil || c.AlwaysProxy ||
+		c.DialTimeout != 7*time.Second {
+		t.Error("not existing config file should use start up options, got", c, err)
+	}
+}
+
+func TestReloadableConfigApply(t *testing.T) {
+	defer setTestConfig(func(*reloadableConfig) {})()
+	oldDial := dialTimeout.get()
+	defer dialTimeout.set(oldDial)
+
+	rc := *rconfig()
+	rc.AlwaysProxy = true
+	rc.DialTimeout = 3 * time.Second
+	rc.apply()
+	if !rconfig().AlwaysProxy || dialTimeout.get() != 3*time.Second {
+		t.Error("reloaded options not applied, got", rconfig(), dialTimeout.get())
+	}
+}
+
+func TestSiteStatReloadUserList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocked, direct := dsFile.alwaysBlocked, dsFile.alwaysDirect
+	dsFile.alwaysBlocked = path.Join(dir, "blocked")
+	dsFile.alwaysDirect = path.Join(dir, "direct")
+	defer func() {
+		dsFile.alwaysBlocked, dsFile.alwaysDirect = blocked, direct
+	}()
+
+	ioutil.WriteFile(dsFile.alwaysBlocked, []byte("old.com\n.oldrule.com\n"), 0644)
+	ss := newSiteStat()
+	ss.load(path.Join(dir, "stat"))
+	ss.Vcnt["learned.com"] = newVisitCnt(5, 0)
+
+	url, _ := ParseRequestURI("www.oldrule.com")
+	if !ss.GetVisitCnt(url).AlwaysBlocked() {
+		t.Fatal("www.oldrule.com should be blocked before reload")
+	}
+
+	ioutil.WriteFile(dsFile.alwaysBlocked, []byte("new.com\n"), 0644)
+	ioutil.WriteFile(dsFile.alwaysDirect, []byte(".oldrule.com\n"), 0644)
+	ss.reloadUserList()
+
+	if vc := ss.get("old.com"); vc != nil {
+		t.Error("site removed from list should be removed, got", vc)
+	}
+	// request for removed site started before reload should not panic
+	oldURL, _ := ParseRequestURI("old.com")
+	ss.TempBlocked(oldURL)
+	if vc := ss.get("new.com"); vc == nil || !vc.AlwaysBlocked() {
+		t.Error("site added to blocked list should be blocked, got", vc)
+	}
+	if vc := ss.get("learned.com"); vc == nil || vc.Direct != 5 {
+		t.Error("learned stat should be kept, got", vc)
+	}
+	if !ss.GetVisitCnt(url).AlwaysDirect() {
+		t.Error("www.oldrule.com should be direct after reload")
+	}
+	if ss.hasBlockedHost["oldrule.com"] {
+		t.Error("domain no longer blocked should not be marked")
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in DNS resolver for direct connection. Answers are cached according
+// to TTL, NXDOMAIN and empty answers are cached for dnsNegativeTTL. Queries
+// for specific domains (and their sub domains) can be sent to specified
+// upstream servers using UDP or TCP. Other domains use the default upstream
+// if specified, otherwise the system resolver, whose answer is cached for
+// dnsSystemTTL as TTL is not available.
+//
+// Answers containing bogus IP are not cached. Resolution stats are shown at
+// http://<listen address>/stat: bogus answers indicate DNS poisoning, while
+// timeout and server failure are ordinary DNS failures.
+
+const (
+	dnsMaxTTL      = time.Hour
+	dnsSystemTTL   = time.Minute
+	dnsNegativeTTL = 30 * time.Second
+	dnsCacheSize   = 4096
+	dnsUDPBufSize  = 1500
+)
+
+type dnsStats struct {
+	query    int
+	fail     int
+	timeout  int
+	nxdomain int
+	bogus    int
+}
+
+// dnsUpstream is a DNS server. network is "udp", "tcp" or "system" for the
+// system resolver.
+type dnsUpstream struct {
+	network string
+	addr    string
+	stats   dnsStats // protected by resolver lock
+}
+
+func (u *dnsUpstream) String() string {
+	if u.network == "system" {
+		return "system"
+	}
+	return u.network + "://" + u.addr
+}
+
+type dnsCacheEntry struct {
+	ips    []net.IP
+	err    error // not nil for negative cache
+	expire time.Time
+}
+
+var resolver = struct {
+	sync.Mutex
+	cache  map[string]*dnsCacheEntry
+	hit    int
+	miss   int
+	def    *dnsUpstream
+	domain map[string]*dnsUpstream // only modified when parsing config
+	all    []*dnsUpstream
+}{
+	cache:  make(map[string]*dnsCacheEntry),
+	def:    &dnsUpstream{network: "system"},
+	domain: make(map[string]*dnsUpstream),
+}
+
+func init() {
+	resolver.all = []*dnsUpstream{resolver.def}
+}
+
+// parseDNSUpstream parses server in the form of [udp|tcp://]host[:port],
+// default is UDP and port 53.
+func parseDNSUpstream(s string) (*dnsUpstream, error) {
+	u := &dnsUpstream{network: "udp"}
+	if i := strings.Index(s, "://"); i != -1 {
+		u.network = strings.ToLower(s[:i])
+		s = s[i+3:]
+	}
+	if u.network != "udp" && u.network != "tcp" {
+		return nil, errors.New("unsupported DNS server protocol " + u.network)
+	}
+	if s == "" {
+		return nil, errors.New("empty DNS server address")
+	}
+	if !hasPort(s) {
+		s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+	}
+	u.addr = s
+	return u, nil
+}
+
+// addDNSServer adds DNS upstream server. val is either a server, which
+// becomes the default upstream, or "domain1, domain2 @ server".
+func addDNSServer(val string) error {
+	var domains []string
+	server := val
+	if i := strings.LastIndex(val, "@"); i != -1 {
+		server = strings.TrimSpace(val[i+1:])
+		for _, d := range strings.Split(val[:i], ",") {
+			if d = strings.ToLower(strings.Trim(strings.TrimSpace(d), ".")); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		if len(domains) == 0 {
+			return errors.New("no domain specified for DNS server " + server)
+		}
+	}
+	u, err := parseDNSUpstream(server)
+	if err != nil {
+		return err
+	}
+	if domains == nil {
+		if resolver.def.network == "system" {
+			resolver.all[0] = u
+		} else {
+			resolver.all = append(resolver.all, u)
+		}
+		resolver.def = u
+		return nil
+	}
+	for _, d := range domains {
+		resolver.domain[d] = u
+	}
+	resolver.all = append(resolver.all, u)
+	return nil
+}
+
+// dnsUpstreamFor returns the upstream for the longest matching domain of
+// host.
+func dnsUpstreamFor(host string) *dnsUpstream {
+	for h := host; ; {
+		if u, ok := resolver.domain[h]; ok {
+			return u
+		}
+		i := strings.IndexByte(h, '.')
+		if i == -1 {
+			return resolver.def
+		}
+		h = h[i+1:]
+	}
+}
+
+// lookupHost returns addresses of host. Error is always *net.DNSError.
+func lookupHost(host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+	resolver.Lock()
+	if e, ok := resolver.cache[host]; ok && now.Before(e.expire) {
+		resolver.hit++
+		resolver.Unlock()
+		return e.ips, e.err
+	}
+	resolver.miss++
+	resolver.Unlock()
+
+	u := dnsUpstreamFor(host)
+	ips, ttl, err := u.lookup(host)
+	return cacheDNSAnswer(host, u, ips, ttl, err)
+}
+
+// cacheDNSAnswer updates stats and cache, converts error to *net.DNSError.
+func cacheDNSAnswer(host string, u *dnsUpstream, ips []net.IP, ttl time.Duration,
+	err error) ([]net.IP, error) {
+	resolver.Lock()
+	defer resolver.Unlock()
+
+	st := &u.stats
+	st.query++
+	negative := false
+	if err != nil {
+		switch {
+		case isErrTimeout(err):
+			st.timeout++
+		case err == dnsRcodeError(dnsRcodeNXDomain):
+			st.nxdomain++
+			negative = true
+		default:
+			if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+				st.nxdomain++
+				negative = true
+			} else {
+				st.fail++
+			}
+		}
+		err = dnsError(host, u, err)
+	} else if len(ips) == 0 {
+		negative = true
+		err = dnsError(host, u, errors.New("no address"))
+	}
+
+	switch {
+	case negative:
+		ttl = dnsNegativeTTL
+	case err != nil:
+		return nil, err
+	case hasBogusIP(ips):
+		st.bogus++
+		return ips, nil
+	case ttl > dnsMaxTTL:
+		ttl = dnsMaxTTL
+	case ttl == 0:
+		return ips, nil
+	}
+
+	if len(resolver.cache) >= dnsCacheSize {
+		now := time.Now()
+		for h, e := range resolver.cache {
+			if now.After(e.expire) {
+				delete(resolver.cache, h)
+			}
+		}
+		if len(resolver.cache) >= dnsCacheSize {
+			resolver.cache = make(map[string]*dnsCacheEntry)
+		}
+	}
+	resolver.cache[host] = &dnsCacheEntry{ips, err, time.Now().Add(ttl)}
+	return ips, err
+}
+
+func dnsError(host string, u *dnsUpstream, err error) error {
+	if de, ok := err.(*net.DNSError); ok {
+		return de
+	}
+	return &net.DNSError{Err: err.Error(), Name: host, Server: u.addr,
+		IsTimeout: isErrTimeout(err)}
+}
+
+func hasBogusIP(ips []net.IP) bool {
+	for _, ip := range ips {
+		if isBogusIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup queries A record, and AAAA record if there's no A record.
+func (u *dnsUpstream) lookup(host string) (ips []net.IP, ttl time.Duration, err error) {
+	if u.network == "system" {
+		ips, err = lookupSystem(host)
+		return ips, dnsSystemTTL, err
+	}
+	var sec uint32
+	ips, sec, err = u.query(host, dnsTypeA)
+	if err == nil && len(ips) == 0 {
+		ips, sec, err = u.query(host, dnsTypeAAAA)
+	}
+	return ips, time.Duration(sec) * time.Second, err
+}
+
+func lookupSystem(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout.get())
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+func (u *dnsUpstream) query(host string, qtype uint16) (ips []net.IP, ttl uint32, err error) {
+	c, err := net.DialTimeout(u.network, u.addr, dialTimeout.get())
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(readTimeout.get()))
+
+	id := uint16(rand.Intn(0x10000))
+	query := dnsTCPQuery(id, host, qtype)
+	var msg []byte
+	if u.network == "tcp" {
+		if msg, err = dnsTCPExchange(c, query); err != nil {
+			return
+		}
+		return parseDNSAnswer(msg, id, qtype)
+	}
+
+	if _, err = c.Write(query[2:]); err != nil {
+		return
+	}
+	msg = make([]byte, dnsUDPBufSize)
+	n, err := c.Read(msg)
+	if err != nil {
+		return
+	}
+	msg = msg[:n]
+	if n > 2 && msg[2]&0x02 != 0 {
+		// truncated, retry with TCP
+		debug.Printf("DNS answer for %s truncated, retry with TCP\n", host)
+		tu := &dnsUpstream{network: "tcp", addr: u.addr}
+		return tu.query(host, qtype)
+	}
+	return parseDNSAnswer(msg, id, qtype)
+}
+
+// dialHost tries to connect to each address in turn until success or
+// timeout.
+func dialHost(ips []net.IP, port string, timeout time.Duration) (c net.Conn, err error) {
+	deadline := time.Now().Add(timeout)
+	for _, ip := range ips {
+		to := time.Until(deadline)
+		if to <= 0 {
+			break
+		}
+		c, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), to)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func genDNSStat() []byte {
+	buf := new(bytes.Buffer)
+	resolver.Lock()
+	defer resolver.Unlock()
+	fmt.Fprintf(buf, "DNS cache: %d entries, %d hit, %d miss\n\n",
+		len(resolver.cache), resolver.hit, resolver.miss)
+	fmt.Fprintf(buf, "%-40s %8s %8s %8s %8s %8s\n", "DNS server", "query",
+		"fail", "timeout", "nxdomain", "bogus")
+	for _, u := range resolver.all {
+		st := u.stats
+		fmt.Fprintf(buf, "%-40s %8d %8d %8d %8d %8d\n", u, st.query, st.fail,
+			st.timeout, st.nxdomain, st.bogus)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddDNSServer(t *testing.T) {
+	def, domain, all := resolver.def, resolver.domain, resolver.all
+	resolver.domain = make(map[string]*dnsUpstream)
+	resolver.all = []*dnsUpstream{resolver.def}
+	defer func() {
+		resolver.def, resolver.domain, resolver.all = def, domain, all
+	}()
+
+	if err := addDNSServer("8.8.8.8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addDNSServer("corp.example.com, Office.LAN. @ tcp://10.0.0.1:5353"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addDNSServer("sub.corp.example.com @ [::1]"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"https://1.1.1.1", " @ 1.1.1.1", "udp://"} {
+		if err := addDNSServer(s); err == nil {
+			t.Errorf("%s should return error\n", s)
+		}
+	}
+	if len(resolver.all) != 3 {
+		t.Error("system resolver should be replaced by default server, got", resolver.all)
+	}
+
+	var testData = []struct {
+		host   string
+		server string
+	}{
+		{"www.google.com", "udp://8.8.8.8:53"},
+		{"corp.example.com", "tcp://10.0.0.1:5353"},
+		{"www.corp.example.com", "tcp://10.0.0.1:5353"},
+		{"a.sub.corp.example.com", "udp://[::1]:53"},
+		{"host.office.lan", "tcp://10.0.0.1:5353"},
+		{"example.com", "udp://8.8.8.8:53"},
+		{"localhost", "udp://8.8.8.8:53"},
+	}
+	for _, td := range testData {
+		if u := dnsUpstreamFor(td.host); u.String() != td.server {
+			t.Errorf("%s should use DNS server %s, got %s\n", td.host, td.server, u)
+		}
+	}
+}
+
+// serveTestDNS answers A query for a.test with 1.2.3.4 and NXDOMAIN for
+// other names. Queried names are sent to the returned channel.
+func serveTestDNS(pc net.PacketConn) chan string {
+	queried := make(chan string, 10)
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			msg := append([]byte(nil), b[:n]...)
+			name := string(msg[13 : n-5])
+			queried <- name
+			msg[2], msg[3] = 0x81, 0x80
+			if name == "a\x04test" {
+				msg[7] = 1
+				msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 1, 2, 3, 4)
+			} else {
+				msg[3] |= dnsRcodeNXDomain
+			}
+			pc.WriteTo(msg, addr)
+		}
+	}()
+	return queried
+}
+
+func TestLookupHostCache(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	queried := serveTestDNS(pc)
+
+	def, domain, all, cache := resolver.def, resolver.domain, resolver.all, resolver.cache
+	resolver.domain = make(map[string]*dnsUpstream)
+	resolver.cache = make(map[string]*dnsCacheEntry)
+	defer func() {
+		resolver.def, resolver.domain, resolver.all, resolver.cache = def, domain, all, cache
+	}()
+	if err := addDNSServer("test @ " + pc.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	u := resolver.domain["test"]
+	hit := resolver.hit
+
+	for i := 0; i < 2; i++ {
+		ips, err := lookupHost("A.test")
+		if err != nil {
+			t.Fatal("lookup a.test:", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+			t.Error("a.test should resolve to 1.2.3.4, got", ips)
+		}
+	}
+	if len(queried) != 1 {
+		t.Error("second lookup should use cache, query count", len(queried))
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := lookupHost("b.test")
+		if de, ok := err.(*net.DNSError); !ok || de.Err != "no such host" {
+			t.Error("b.test should get no such host error, got", err)
+		}
+	}
+	if len(queried) != 2 {
+		t.Error("NXDOMAIN should be cached, query count", len(queried))
+	}
+	if u.stats.query != 2 || u.stats.nxdomain != 1 {
+		t.Errorf("DNS stats wrong: %+v\n", u.stats)
+	}
+	if resolver.hit-hit != 2 {
+		t.Error("cache hit should be 2, got", resolver.hit-hit)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Per site parent proxy routing. Parent proxies can be named with the
+// proxyName option, multiple parents sharing the same name form a group.
+// Each line in the route file contains a host or domain and a comma
+// separated list of parent names:
+//
+//	example.com   us, corp
+//
+// Connections through parent proxy to matching sites use only the listed
+// parents, tried in the given order. Parents in a group are tried in the
+// order they appear in config. Host and domain matching is the same as the
+// blocked site list.
+
+var parentProxyGroup = make(map[string][]int) // name -> parent proxy id
+
+var parentRoute = make(map[string][]int) // host or domain -> parent proxy id
+
+func nameParentProxy(name string) {
+	if len(parentProxy) == 0 {
+		Fatal("must specify a parent proxy before proxyName")
+	}
+	if name == "" || strings.ContainsAny(name, ", \t") {
+		Fatalf("proxyName %q should not be empty or contain comma or space\n", name)
+	}
+	id := len(parentProxy) - 1
+	parentProxyGroup[name] = append(parentProxyGroup[name], id)
+}
+
+func parseRouteLine(line string) (site string, ids []int, err error) {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return "", nil, fmt.Errorf("route %q should be: host parent[, parent...]", line)
+	}
+	site = strings.ToLower(f[0])
+	for _, name := range strings.Split(strings.Join(f[1:], ""), ",") {
+		if name == "" {
+			continue
+		}
+		group, ok := parentProxyGroup[name]
+		if !ok {
+			return "", nil, fmt.Errorf("route %q: no parent proxy named %s", line, name)
+		}
+		ids = append(ids, group...)
+	}
+	if len(ids) == 0 {
+		return "", nil, fmt.Errorf("route %q has no parent proxy", line)
+	}
+	return
+}
+
+func loadParentRoute(fpath string) {
+	lst, err := loadSiteList(fpath)
+	if err != nil {
+		return
+	}
+	for _, line := range lst {
+		if line[0] == '#' {
+			continue
+		}
+		site, ids, err := parseRouteLine(line)
+		if err != nil {
+			Fatalf("%s: %v\n", fpath, err)
+		}
+		parentRoute[site] = ids
+	}
+}
+
+func initParentRoute() {
+	loadParentRoute(dsFile.route)
+	if len(parentRoute) != 0 {
+		debug.Printf("loaded %d parent proxy route\n", len(parentRoute))
+	}
+}
+
+// routeProxyIds returns the parent proxies to use for url, nil if there's no
+// route for the site.
+func routeProxyIds(url *URL) []int {
+	if ids, ok := parentRoute[url.Host]; ok {
+		return ids
+	}
+	if url.Domain != "" && len(url.Domain) != len(url.Host) {
+		return parentRoute[url.Domain]
+	}
+	return nil
+}
+
+// hasParentRoute returns true if there's route for host or its domain.
+func hasParentRoute(host string) bool {
+	if _, ok := parentRoute[host]; ok {
+		return true
+	}
+	_, ok := parentRoute[host2Domain(host)]
+	return ok
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRouteLine(t *testing.T) {
+	parentProxyGroup = map[string][]int{"us": {1, 2}, "corp": {0}}
+	defer func() {
+		parentProxyGroup = make(map[string][]int)
+	}()
+
+	var testData = []struct {
+		line string
+		site string
+		ids  []int
+		ok   bool
+	}{
+		{"example.com corp", "example.com", []int{0}, true},
+		{"Example.COM us,corp", "example.com", []int{1, 2, 0}, true},
+		{"www.example.com\tcorp , us", "www.example.com", []int{0, 1, 2}, true},
+		{"example.com", "", nil, false},
+		{"example.com jp", "", nil, false},
+		{"example.com ,", "", nil, false},
+	}
+	for _, td := range testData {
+		site, ids, err := parseRouteLine(td.line)
+		if (err == nil) != td.ok {
+			t.Errorf("route %q error %v\n", td.line, err)
+			continue
+		}
+		if site != td.site || !equalIntSlice(ids, td.ids) {
+			t.Errorf("route %q got %s %v, want %s %v\n", td.line, site, ids, td.site, td.ids)
+		}
+	}
+}
+
+func equalIntSlice(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRouteProxyIds(t *testing.T) {
+	parentRoute = map[string][]int{"google.com": {1}, "www.google.com": {2}}
+	defer func() {
+		parentRoute = make(map[string][]int)
+	}()
+
+	var testData = []struct {
+		url string
+		ids []int
+	}{
+		{"www.google.com", []int{2}},
+		{"mail.google.com", []int{1}},
+		{"google.com", []int{1}},
+		{"www.example.com", nil},
+		{"127.0.0.1", nil},
+	}
+	for _, td := range testData {
+		url, err := ParseRequestURI(td.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := routeProxyIds(url); !equalIntSlice(ids, td.ids) {
+			t.Errorf("%s route %v, want %v\n", td.url, ids, td.ids)
+		}
+	}
+}
+
+func TestCreateConnectionRoute(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+
+	hasParentProxy = true
+	defer func() { hasParentProxy = false }()
+	defer initTestParentProxy(func(*URL) (conn, error) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		return conn{c, ctSocksConn, nil}, err
+	})()
+	url, _ := ParseRequestURI(ln.Addr().String())
+	parentRoute = map[string][]int{url.Host: {0}}
+	defer func() {
+		parentRoute = make(map[string][]int)
+	}()
+
+	vc := newVisitCnt(20, 0)
+	if !vc.AsDirect() {
+		t.Fatal("site should be learned as direct")
+	}
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	c := newClientConn(srv, nil)
+	cn, _, err := c.createConnection(&Request{URL: url}, vc)
+	if err != nil {
+		t.Fatal("create connection:", err)
+	}
+	cn.Close()
+	if cn.connType != ctSocksConn {
+		t.Errorf("routed direct site connection type %s, want parent proxy\n", ctName[cn.connType])
+	}
+}
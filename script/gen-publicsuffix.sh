@@ -0,0 +1,30 @@
+#!/bin/bash
+
+# Generate publicsuffix_list.go from the Public Suffix List.
+# Usage: gen-publicsuffix.sh [public_suffix_list.dat]
+# Downloads the list if no file is given.
+
+cd "$( dirname "${BASH_SOURCE[0]}" )/.."
+
+url=https://publicsuffix.org/list/public_suffix_list.dat
+src=$1
+if [[ -z $src ]]; then
+    src=`mktemp`
+    trap "rm -f $src" EXIT
+    curl -sSL -o $src $url || exit 1
+fi
+
+out=publicsuffix_list.go
+{
+    echo "package main"
+    echo
+    echo "// Generated by script/gen-publicsuffix.sh from the Public Suffix List"
+    echo "// ($url), do not edit."
+    echo "// Rules containing non-ASCII labels are omitted."
+    echo
+    echo 'const publicSuffixList = `'
+    # first field of non comment lines, skip non-ASCII rules
+    LC_ALL=C awk '!/^\/\// && NF > 0 { print $1 }' $src | LC_ALL=C grep -v '[^ -~]'
+    echo '`'
+} > $out
+echo "generated $out with `grep -c '^[a-z0-9*!]' $out` rules"
@@ -3,44 +3,76 @@ package main
 import (
 	"errors"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"strings"
 )
 
 var noShadowSocksErr = errors.New("No shadowsocks configuration")
 
-var cipher []ss.Cipher
+// shadowsocksParent is a shadowsocks server used as parent proxy.
+type shadowsocksParent struct {
+	ParentProxyStats
+	server string
+	method string // empty for default encryption method
+	passwd string
+	cipher ss.Cipher
+}
+
+var shadowsocksParents []*shadowsocksParent
+
+func init() {
+	RegisterParentProxy("ss", func(server, methodPasswd string) (ParentProxy, error) {
+		// shadowsocks encryption method contains no ':'
+		arr := strings.SplitN(methodPasswd, ":", 2)
+		if len(arr) != 2 || arr[1] == "" {
+			return nil, errors.New("should specify method:passwd for shadowsocks")
+		}
+		sp := newShadowsocksParent(server)
+		sp.method, sp.passwd = arr[0], arr[1]
+		return sp, nil
+	})
+}
+
+// Cipher is created in initShadowSocks, as shadowPasswd and shadowMethod
+// options come after shadowSocks.
+func newShadowsocksParent(server string) *shadowsocksParent {
+	sp := &shadowsocksParent{server: server}
+	shadowsocksParents = append(shadowsocksParents, sp)
+	return sp
+}
 
 func initShadowSocks() {
 	// error checking is done when parsing config
-	if len(config.ShadowSocks) == 0 {
-		return
-	}
-	for i, _ := range config.ShadowSocks {
+	for _, sp := range shadowsocksParents {
 		// initialize cipher for each shadowsocks connection
-		if c, err := ss.NewCipher(config.ShadowMethod[i], config.ShadowPasswd[i]); err != nil {
+		c, err := ss.NewCipher(sp.method, sp.passwd)
+		if err != nil {
 			Fatal("creating shadowsocks cipher:", err)
-		} else {
-			cipher = append(cipher, c)
 		}
+		sp.cipher = c
 		if debug {
-			if config.ShadowMethod[i] != "" {
-				debug.Println("shadowsocks server:", config.ShadowSocks[i], "encryption:", config.ShadowMethod[i])
+			if sp.method != "" {
+				debug.Println("shadowsocks server:", sp.server, "encryption:", sp.method)
 			} else {
-				debug.Println("shadowsocks server:", config.ShadowSocks[i])
+				debug.Println("shadowsocks server:", sp.server)
 			}
 		}
 	}
 }
 
-// Create shadowsocks connection function which uses the ith shadowsocks server
-func createShadowSocksConnecter(i int) parentProxyConnectionFunc {
-	f := func(url *URL) (cn conn, err error) {
-		c, err := ss.Dial(url.HostPort, config.ShadowSocks[i], cipher[i].Copy())
-		if err != nil {
-			errl.Printf("can't create shadowsocks connection for: %s %v\n", url.HostPort, err)
-			return zeroConn, err
-		}
-		debug.Println("connected to:", url.HostPort, "via shadowsocks:", config.ShadowSocks[i])
-		return conn{c, ctShadowctSocksConn}, nil
+func (sp *shadowsocksParent) Name() string {
+	return "shadowsocks " + sp.server
+}
+
+func (sp *shadowsocksParent) Close() error {
+	return nil
+}
+
+func (sp *shadowsocksParent) Dial(url *URL) (cn conn, err error) {
+	c, err := ss.Dial(url.HostPort, sp.server, sp.cipher.Copy())
+	if err != nil {
+		errl.Printf("can't create shadowsocks connection for: %s %v\n", url.HostPort, err)
+		return zeroConn, err
 	}
-	return f
+	debug.Println("connected to:", url.HostPort, "via shadowsocks:", sp.server)
+	return conn{c, ctShadowctSocksConn, sp}, nil
 }
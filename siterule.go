@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Pattern rules in blocked and direct list. Besides plain host and domain,
+// each line in the list can be:
+//
+//	.example.com           suffix, matches example.com and all its sub domains
+//	*.cdn.example.com      wildcard, '*' matches any characters, '?' matches one
+//	/^api\d+\.foo\.net$/   regular expression (RE2 syntax) on lower case host name
+//	10.8.0.0/16            IP range in CIDR notation, only matches IP host
+//
+// Rules imported from GFWList (refer to gfwlist.go) have lower precedence
+// than user specified lists. Precedence in deciding a host's visit count:
+//  1. Host in the lists
+//  2. Pattern rules in user lists, blocked list takes precedence over direct
+//  3. Domain in the lists
+//  4. Imported rules, exceptions take precedence over blocking rules
+//  5. Learned stat
+//
+// Visit count for host matching pattern rules is added to site stat as user
+// specified, so it's not stored in stat file.
+
+type siteRule struct {
+	pattern string
+	source  string // list file containing the rule
+	blocked bool
+
+	host   string // exact host
+	suffix string
+	re     *regexp.Regexp
+	url    bool // re matches URL instead of host
+	ipnet  *net.IPNet
+}
+
+// parseSiteRule returns nil rule and nil error for plain host or domain.
+func parseSiteRule(s string) (*siteRule, error) {
+	r := &siteRule{pattern: s}
+	var err error
+	switch {
+	case len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/':
+		r.re, err = regexp.Compile(s[1 : len(s)-1])
+	case strings.ContainsAny(s, "*?"):
+		r.re, err = regexp.Compile(wildcard2Regexp(strings.ToLower(s)))
+	case len(s) > 1 && s[0] == '.':
+		r.suffix = strings.ToLower(s[1:])
+	case strings.IndexByte(s, '/') != -1:
+		_, r.ipnet, err = net.ParseCIDR(s)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func wildcard2Regexp(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('^')
+	for _, c := range s {
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteByte('.')
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteByte('$')
+	return buf.String()
+}
+
+// match checks host against the rule. ip is nil if host is not IP.
+func (r *siteRule) match(host string, ip net.IP) bool {
+	switch {
+	case r.ipnet != nil:
+		return ip != nil && r.ipnet.Contains(ip)
+	case ip != nil:
+		return false
+	case r.url:
+		// Only host is known for CONNECT request, so use root path.
+		return r.re.MatchString("http://"+host+"/") || r.re.MatchString("https://"+host+"/")
+	case r.re != nil:
+		return r.re.MatchString(host)
+	case r.host != "":
+		return host == r.host
+	default:
+		return host == r.suffix || strings.HasSuffix(host, "."+r.suffix)
+	}
+}
+
+// parseRuleList parses pattern rules in lst, returns plain hosts and domains.
+func parseRuleList(lst []string, fpath string, blocked bool) (rules []*siteRule, plain []string) {
+	for _, s := range lst {
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		r, err := parseSiteRule(s)
+		if err != nil {
+			errl.Printf("Invalid rule %s in %s: %v\n", s, fpath, err)
+			continue
+		}
+		if r == nil {
+			plain = append(plain, s)
+		} else {
+			r.source = fpath
+			r.blocked = blocked
+			rules = append(rules, r)
+		}
+	}
+	return
+}
+
+func matchSiteRule(rules []*siteRule, host string) *siteRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	host = strings.ToLower(trimLastDot(host))
+	var ip net.IP
+	if hostIsIP(host) {
+		ip = net.ParseIP(host)
+	}
+	for _, r := range rules {
+		if r.match(host, ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+func ruleVisitCnt(r *siteRule) *VisitCnt {
+	if r.blocked {
+		return newVisitCntWithTime(0, userCnt, zeroTime)
+	}
+	return newVisitCntWithTime(userCnt, 0, zeroTime)
+}
+
+// createFromRule adds visit count for host matching rules, returns nil if
+// no rule matches.
+func (ss *SiteStat) createFromRule(url *URL, rules []*siteRule) *VisitCnt {
+	r := matchSiteRule(rules, url.Host)
+	if r == nil {
+		return nil
+	}
+	if debug {
+		debug.Printf("%s matches rule %s in %s\n", url.Host, r.pattern, r.source)
+	}
+	vcnt := ruleVisitCnt(r)
+	ss.vcLock.Lock()
+	ss.Vcnt[url.Host] = vcnt
+	ss.vcLock.Unlock()
+	if r.blocked && url.Domain != "" {
+		ss.hbhLock.Lock()
+		ss.hasBlockedHost[url.Domain] = true
+		ss.hbhLock.Unlock()
+	}
+	return vcnt
+}
+
+// applyRules replaces learned stat of hosts matching rules. Called upon
+// loading. Replaced stat is kept in ruleShadowed.
+func (ss *SiteStat) applyRules() {
+	for host, vcnt := range ss.Vcnt {
+		if vcnt.userSpecified() {
+			continue
+		}
+		r := matchSiteRule(ss.userRules, host)
+		if r == nil {
+			if dmcnt := ss.Vcnt[host2Domain(host)]; dmcnt != nil && dmcnt.userSpecified() {
+				continue
+			}
+			r = matchSiteRule(ss.importRules, host)
+		}
+		if r != nil {
+			ss.ruleShadowed[host] = vcnt
+			ss.Vcnt[host] = ruleVisitCnt(r)
+		}
+	}
+}
+
+// jsCompatibleRegexp returns false if regular expression re uses RE2 syntax
+// not supported or having different meaning in JavaScript, e.g. flags (?i),
+// named group (?P<name>), Unicode class \pL and POSIX class [[:alpha:]].
+func jsCompatibleRegexp(re string) bool {
+	inClass := false
+	for i := 0; i < len(re); i++ {
+		switch c := re[i]; {
+		case c == '\\' && i+1 < len(re):
+			i++
+			switch re[i] {
+			case 'p', 'P', 'A', 'z', 'Q', 'E', 'C':
+				return false
+			case 'x':
+				if i+1 < len(re) && re[i+1] == '{' {
+					return false
+				}
+			}
+		case c == '[' && inClass:
+			if i+1 < len(re) && re[i+1] == ':' {
+				return false
+			}
+		case c == '[':
+			inClass = true
+			if i+1 < len(re) && re[i+1] == '^' {
+				i++
+			}
+			// leading ']' is literal in RE2, but ends empty class in JavaScript
+			if i+1 < len(re) && re[i+1] == ']' {
+				return false
+			}
+		case c == ']':
+			inClass = false
+		case c == '(' && !inClass:
+			if strings.HasPrefix(re[i:], "(?") && !strings.HasPrefix(re[i:], "(?:") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// genPACRules generates JavaScript array elements for rules, which is
+// checked by matchRule in PAC. IPv6 range and regular expression not
+// compatible with JavaScript are not supported in PAC.
+func genPACRules(rules []*siteRule) string {
+	var lines []string
+	for _, r := range rules {
+		var js string
+		switch {
+		case r.ipnet != nil:
+			ip4 := r.ipnet.IP.To4()
+			if ip4 == nil || len(r.ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			js = fmt.Sprintf("net: %d, mask: %d", binary.BigEndian.Uint32(ip4),
+				binary.BigEndian.Uint32(r.ipnet.Mask))
+		case r.re != nil:
+			if !jsCompatibleRegexp(r.re.String()) {
+				errl.Printf("Rule %s in %s not supported in PAC, regular expression syntax "+
+					"incompatible with JavaScript\n", r.pattern, r.source)
+				continue
+			}
+			re, _ := json.Marshal(r.re.String())
+			js = fmt.Sprintf("re: new RegExp(%s), url: %v", re, r.url)
+		case r.host != "":
+			host, _ := json.Marshal(r.host)
+			js = fmt.Sprintf("host: %s", host)
+		default:
+			suffix, _ := json.Marshal(r.suffix)
+			js = fmt.Sprintf("suffix: %s", suffix)
+		}
+		lines = append(lines, fmt.Sprintf("{%s, proxy: %v}", js, r.blocked))
+	}
+	return strings.Join(lines, ",\n")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSiteRuleMatch(t *testing.T) {
+	var testData = []struct {
+		rule  string
+		host  string
+		match bool
+	}{
+		{".example.com", "example.com", true},
+		{".example.com", "a.b.example.com", true},
+		{".example.com", "badexample.com", false},
+		{"*.cdn.example.com", "img.cdn.example.com", true},
+		{"*.cdn.example.com", "a.img.cdn.example.com", true},
+		{"*.cdn.example.com", "cdn.example.com", false},
+		{"api-*.foo.net", "api-1.foo.net", true},
+		{"api-*.foo.net", "www.foo.net", false},
+		{"img?.foo.net", "img1.foo.net", true},
+		{"img?.foo.net", "img12.foo.net", false},
+		{`/^api\d+\.foo\.net$/`, "api12.foo.net", true},
+		{`/^api\d+\.foo\.net$/`, "apix.foo.net", false},
+		{"10.8.0.0/16", "10.8.3.4", true},
+		{"10.8.0.0/16", "10.9.3.4", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+	}
+	for _, td := range testData {
+		r, err := parseSiteRule(td.rule)
+		if err != nil || r == nil {
+			t.Fatalf("%s should be valid rule, err: %v\n", td.rule, err)
+		}
+		if r.match(td.host, net.ParseIP(td.host)) != td.match {
+			t.Errorf("%s match %s should be %v\n", td.rule, td.host, td.match)
+		}
+	}
+
+	for _, s := range []string{"example.com", "www.example.com", "1.2.3.4"} {
+		if r, err := parseSiteRule(s); r != nil || err != nil {
+			t.Errorf("%s should be plain site, got %v %v\n", s, r, err)
+		}
+	}
+	for _, s := range []string{"/a(b/", "10.8.0.0/33"} {
+		if _, err := parseSiteRule(s); err == nil {
+			t.Errorf("%s should be invalid rule\n", s)
+		}
+	}
+}
+
+func TestSiteRulePrecedence(t *testing.T) {
+	ss := newSiteStat()
+	blockedRules, _ := parseRuleList([]string{"*.blocked.example.com", "10.8.0.0/16"}, "blocked", true)
+	directRules, plain := parseRuleList([]string{".example.com", "# comment", "foo.com"}, "direct", false)
+	ss.userRules = append(blockedRules, directRules...)
+	ss.importRules = []*siteRule{
+		{pattern: "@@||ok.bar.com", suffix: "ok.bar.com"},
+		{pattern: "||bar.com", suffix: "bar.com", blocked: true},
+		{pattern: "||foo.com", suffix: "foo.com", blocked: true},
+	}
+	if len(plain) != 1 || plain[0] != "foo.com" {
+		t.Error("plain site in list should be returned, got", plain)
+	}
+	ss.loadList(plain, userCnt, 0)
+	ss.loadList([]string{"www.blocked.example.com"}, userCnt, 0)
+	ss.Vcnt["learned.example.com"] = newVisitCnt(0, 5)
+	ss.applyRules()
+
+	var testData = []struct {
+		host    string
+		direct  bool
+		blocked bool
+	}{
+		{"www.blocked.example.com", true, false}, // host in list first
+		{"img.blocked.example.com", false, true}, // blocked rule before direct rule
+		{"a.example.com", true, false},
+		{"learned.example.com", true, false}, // rule over learned stat
+		{"10.8.1.1", false, true},
+		{"10.9.1.1", true, false},     // IP without rule is direct
+		{"www.foo.com", true, false},  // domain in list before imported rule
+		{"www.bar.com", false, true},  // imported rule
+		{"a.ok.bar.com", true, false}, // imported exception
+		{"www.baz.com", false, false},
+	}
+	for _, td := range testData {
+		url, _ := ParseRequestURI(td.host)
+		vc := ss.GetVisitCnt(url)
+		if vc.AlwaysDirect() != td.direct || vc.AlwaysBlocked() != td.blocked {
+			t.Errorf("%s should be direct %v blocked %v, got %+v\n", td.host, td.direct, td.blocked, vc)
+		}
+	}
+	if !ss.hasBlockedHost["example.com"] {
+		t.Error("domain with host matching blocked rule should be marked")
+	}
+}
+
+func TestGenPACRules(t *testing.T) {
+	rules, _ := parseRuleList([]string{".example.com", "api-*.foo.net", "10.8.0.0/16", "2001:db8::/32"}, "test", true)
+	rules = append(rules, &siteRule{host: "www.foo.com"})
+	js := genPACRules(rules)
+	expected := `{suffix: "example.com", proxy: true},
+{re: new RegExp("^api-.*\\.foo\\.net$"), url: false, proxy: true},
+{net: 168296448, mask: 4294901760, proxy: true},
+{host: "www.foo.com", proxy: false}`
+	if js != expected {
+		t.Errorf("PAC rules wrong, got\n%s\nexpected\n%s\n", js, expected)
+	}
+}
+
+func TestJSCompatibleRegexp(t *testing.T) {
+	var testData = []struct {
+		re string
+		ok bool
+	}{
+		{`^api\d+\.foo\.net$`, true},
+		{`^(?:www|api)\.foo\.net$`, true},
+		{`^[a-z\-]+\.foo\.net$`, true},
+		{`(?i)^api\.foo\.net$`, false},
+		{`^(?P<name>api)\.foo\.net$`, false},
+		{`^\pL+\.foo\.net$`, false},
+		{`^\p{Han}+\.foo\.net$`, false},
+		{`^[[:alpha:]]+\.foo\.net$`, false},
+		{`^[]a]+\.foo\.net$`, false},
+		{`^\x{61}\.foo\.net\z`, false},
+	}
+	for _, td := range testData {
+		if jsCompatibleRegexp(td.re) != td.ok {
+			t.Errorf("%s JavaScript compatible should be %v\n", td.re, td.ok)
+		}
+	}
+
+	rules, _ := parseRuleList([]string{`/(?i)^api\.foo\.net$/`}, "test", true)
+	if len(rules) != 1 {
+		t.Fatal("RE2 regular expression rule should be parsed")
+	}
+	if js := genPACRules(rules); js != "" {
+		t.Error("incompatible regular expression should be skipped in PAC, got", js)
+	}
+}
+
+func TestSiteStatRuleShadowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stfile := path.Join(dir, "stat")
+
+	ss := newSiteStat()
+	ss.importRules = []*siteRule{{pattern: "||bar.com", suffix: "bar.com", blocked: true}}
+	ss.Vcnt["www.bar.com"] = newVisitCnt(7, 0)
+	ss.applyRules()
+	url, _ := ParseRequestURI("www.bar.com")
+	if !ss.GetVisitCnt(url).AlwaysBlocked() {
+		t.Fatal("imported rule should take precedence over learned stat")
+	}
+
+	if err := ss.store(stfile); err != nil {
+		t.Fatal("store error:", err)
+	}
+	ld := newSiteStat()
+	if _, err := ld.loadFile(stfile); err != nil {
+		t.Fatal("load error:", err)
+	}
+	if vc := ld.Vcnt["www.bar.com"]; vc == nil || vc.Direct != 7 {
+		t.Error("learned stat replaced by rule should be stored, got", vc)
+	}
+
+	// rule removed upon reload
+	ss.reloadUserList()
+	if vc := ss.GetVisitCnt(url); vc.userSpecified() || vc.Direct != 7 {
+		t.Error("learned stat should be restored after rule removed, got", vc)
+	}
+}
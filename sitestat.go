@@ -7,6 +7,7 @@ import (
 	"github.com/cyfdecyf/bufio"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"strings"
@@ -21,18 +22,31 @@ func init() {
 // VisitCnt and SiteStat are used to track how many times a site is visited.
 // With this information: COW knows which sites are frequently visited, and
 // judging whether a site is blocked or not is more reliable.
+//
+// Direct and blocked visits are recorded as scores which decay exponentially
+// with config.VisitHalfLife, so old visits count less than recent ones. A site
+// blocked long ago gets direct visit again once its blocked score decays.
+// Decision is based on confidence, which is the proportion of one score in
+// all visits, and the latest visit result.
 
 const (
-	directDelta  = 20
-	blockedDelta = 10
-	maxCnt       = 100 // no protect to update visit cnt, smaller value is unlikely to overflow
-	userCnt      = -1  // this represents user specified host or domain
+	directConfidence  = 0.95 // about 19 recent direct visits
+	blockedConfidence = 0.9  // about 9 recent blocked visits
+	maxScore          = 100  // keeps some chance to retry direct connection for blocked site
+	userCnt           = -1   // this represents user specified host or domain
+
+	defaultVisitHalfLife = 7 * 24 * time.Hour
 )
 
 type siteVisitMethod int
 
-// minus operation on visit count may get negative value, so use signed int
-type vcntint int8
+// Decayed visit score. Score is the value at the time of the last
+// corresponding visit.
+type vscore float64
+
+// visitTime is Unix time in nanoseconds, 0 if never visited. Use integer so
+// that it can be updated without lock.
+type visitTime int64
 
 type Date time.Time
 
@@ -52,35 +66,102 @@ func (d *Date) UnmarshalJSON(input []byte) error {
 	return err
 }
 
-// COW don't need very accurate visit count, so update to visit count value is
-// not protected.
+func newVisitTime(t time.Time) visitTime {
+	if t.IsZero() {
+		return 0
+	}
+	return visitTime(t.UnixNano())
+}
+
+func (t visitTime) Time() time.Time {
+	return time.Unix(0, int64(t))
+}
+
+func (t visitTime) MarshalJSON() ([]byte, error) {
+	return []byte("\"" + t.Time().Format(time.RFC3339Nano) + "\""), nil
+}
+
+func (t *visitTime) UnmarshalJSON(input []byte) error {
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		return err
+	}
+	tm, err := time.Parse(time.RFC3339Nano, s)
+	*t = newVisitTime(tm)
+	return err
+}
+
+// decay returns score s recorded at time t decayed to now.
+func (s vscore) decay(t visitTime, now time.Time) float64 {
+	if s <= 0 || t == 0 {
+		return float64(s)
+	}
+	age := now.Sub(t.Time())
+	if age <= 0 {
+		return float64(s)
+	}
+	return float64(s) * math.Exp2(-float64(age)/float64(config.VisitHalfLife))
+}
+
+// COW don't need very accurate visit count, so reading visit score is not
+// protected.
 type VisitCnt struct {
-	Direct    vcntint   `json:"direct"`
-	Blocked   vcntint   `json:"block"`
-	Recent    Date      `json:"recent"`
-	rUpdated  bool      // whether Recent is updated, we only need date precision
-	blockedOn time.Time // when is the site last blocked
+	Direct      vscore    `json:"direct"`
+	Blocked     vscore    `json:"block"`
+	LastDirect  visitTime `json:"last_direct,omitempty"`
+	LastBlocked visitTime `json:"last_block,omitempty"`
+	Recent      *Date     `json:"recent,omitempty"` // last visit in stat file version 2 and earlier
+	blockedOn   time.Time // when is the site last blocked
 }
 
-func newVisitCnt(direct, blocked vcntint) *VisitCnt {
-	return &VisitCnt{direct, blocked, Date(time.Now()), true, zeroTime}
+func newVisitCnt(direct, blocked vscore) *VisitCnt {
+	return newVisitCntWithTime(direct, blocked, time.Now())
 }
 
-func newVisitCntWithTime(direct, blocked vcntint, t time.Time) *VisitCnt {
-	return &VisitCnt{direct, blocked, Date(t), true, zeroTime}
+// newVisitCntWithTime sets last visit time for positive score.
+func newVisitCntWithTime(direct, blocked vscore, t time.Time) *VisitCnt {
+	vc := &VisitCnt{Direct: direct, Blocked: blocked}
+	if direct > 0 {
+		vc.LastDirect = newVisitTime(t)
+	}
+	if blocked > 0 {
+		vc.LastBlocked = newVisitTime(t)
+	}
+	return vc
 }
 
 func (vc *VisitCnt) userSpecified() bool {
 	return vc.Blocked == userCnt || vc.Direct == userCnt
 }
 
+// confidence returns the proportion of score s in all visits. The extra 1
+// in divisor avoids high confidence with few visits.
+func (vc *VisitCnt) confidence(s vscore, t visitTime) float64 {
+	now := time.Now()
+	v := s.decay(t, now)
+	all := vc.Direct.decay(vc.LastDirect, now) + vc.Blocked.decay(vc.LastBlocked, now)
+	return v / (all + 1)
+}
+
+func (vc *VisitCnt) lastVisit() visitTime {
+	if vc.LastDirect > vc.LastBlocked {
+		return vc.LastDirect
+	}
+	return vc.LastBlocked
+}
+
 const siteStaleThreshold = 10 * 24 * time.Hour
 
 // shouldDrop returns true if the a VisitCnt is not visited for a long time
-// (several days) or is specified by user.
+// (several days) and its scores have decayed to less than a single visit, or
+// is specified by user.
 func (vc *VisitCnt) shouldDrop() bool {
-	return vc.userSpecified() || time.Now().Sub(time.Time(vc.Recent)) > siteStaleThreshold ||
-		(vc.Blocked == 0 && vc.Direct == 0)
+	if vc.userSpecified() || (vc.Blocked == 0 && vc.Direct == 0) {
+		return true
+	}
+	now := time.Now()
+	return now.Sub(vc.lastVisit().Time()) > siteStaleThreshold &&
+		vc.Direct.decay(vc.LastDirect, now)+vc.Blocked.decay(vc.LastBlocked, now) < 1
 }
 
 const tmpBlockedTimeout = 2 * time.Minute
@@ -89,17 +170,24 @@ func (vc *VisitCnt) AsTempBlocked() bool {
 	return time.Now().Sub(vc.blockedOn) < tmpBlockedTimeout
 }
 
+// AsDirect requires the latest visit is direct.
 func (vc *VisitCnt) AsDirect() bool {
-	return (vc.Direct == userCnt) || (vc.Direct-vc.Blocked >= directDelta && vc.Blocked == 0)
+	return (vc.Direct == userCnt) || (vc.LastDirect > vc.LastBlocked &&
+		vc.confidence(vc.Direct, vc.LastDirect) >= directConfidence)
 }
 
+// AsBlocked requires the latest visit is blocked. One successful direct
+// visit probably means the site is not actually blocked.
 func (vc *VisitCnt) AsBlocked() bool {
 	if vc.Blocked == userCnt || vc.AsTempBlocked() {
 		return true
 	}
+	if vc.LastBlocked <= vc.LastDirect {
+		return false
+	}
 	// add some randomness to fix mistake
-	delta := vc.Blocked - vc.Direct
-	return delta >= blockedDelta && rand.Intn(int(delta)) != 0
+	conf := vc.confidence(vc.Blocked, vc.LastBlocked)
+	return conf >= blockedConfidence && rand.Float64() < conf
 }
 
 func (vc *VisitCnt) AlwaysDirect() bool {
@@ -111,45 +199,38 @@ func (vc *VisitCnt) AlwaysBlocked() bool {
 }
 
 func (vc *VisitCnt) OnceBlocked() bool {
-	return vc.Blocked > 0 || vc.AlwaysBlocked() || vc.AsTempBlocked()
+	return (vc.Blocked > 0 && vc.LastBlocked > vc.LastDirect) || vc.AlwaysBlocked() ||
+		vc.AsTempBlocked()
 }
 
 func (vc *VisitCnt) tempBlocked() {
 	vc.blockedOn = time.Now()
 }
 
-// time.Time is composed of 3 fields, so need lock to protect update. As
-// update of last visit is not frequent (at most once for each domain), use a
-// global lock to avoid associating a lock to each VisitCnt.
+// Score and its time should be updated together. As update of visit is not
+// frequent (at most once for each connection), use a global lock to avoid
+// associating a lock to each VisitCnt.
 var visitLock sync.Mutex
 
-// visit updates visit cnt
-func (vc *VisitCnt) visit(inc *vcntint) {
-	if *inc < maxCnt {
-		*inc++
-	}
-	// Because of concurrent update, possible for *inc to overflow and become
-	// negative, but very unlikely.
-	if *inc > maxCnt || *inc < 0 {
-		*inc = maxCnt
-	}
-
-	if !vc.rUpdated {
-		vc.rUpdated = true
-		visitLock.Lock()
-		vc.Recent = Date(time.Now())
-		visitLock.Unlock()
+// visit decays score and adds a new visit.
+func (vc *VisitCnt) visit(score *vscore, last *visitTime) {
+	now := time.Now()
+	visitLock.Lock()
+	s := score.decay(*last, now) + 1
+	if s > maxScore {
+		s = maxScore
 	}
+	// keep stat file compact
+	*score = vscore(math.Round(s*100) / 100)
+	*last = newVisitTime(now)
+	visitLock.Unlock()
 }
 
 func (vc *VisitCnt) DirectVisit() {
 	if networkBad() || vc.userSpecified() {
 		return
 	}
-	// one successful direct visit probably means the site is not actually
-	// blocked
-	vc.visit(&vc.Direct)
-	vc.Blocked = 0
+	vc.visit(&vc.Direct, &vc.LastDirect)
 }
 
 func (vc *VisitCnt) BlockedVisit() {
@@ -157,28 +238,60 @@ func (vc *VisitCnt) BlockedVisit() {
 		return
 	}
 	// When a site changes from direct to blocked by GFW, COW should learn
-	// this quickly and remove it from the PAC ASAP. So change direct to 0
-	// once there's a single blocked visit, this ensures the site is removed
-	// upon the next PAC update.
-	vc.visit(&vc.Blocked)
-	vc.Direct = 0
+	// this quickly and remove it from the PAC ASAP. As AsDirect requires the
+	// latest visit is direct, the site is removed upon the next PAC update.
+	vc.visit(&vc.Blocked, &vc.LastBlocked)
 }
 
+// Version of stat file format. Stat file without version field is version 1,
+// version 2 adds blocked_domain and temp_blocked, version 3 uses decayed
+// visit score and last visit time of each score instead of visit count and
+// recent date.
+const siteStatVersion = 3
+
+// Number of rotated stat file backups, named stat.1, stat.2 ...
+const siteStatBackupCnt = 2
+
+// Domains marked as having blocked host by detection are kept in stat file
+// for this long.
+const blockedDomainKeep = 2 * 24 * time.Hour
+
 type SiteStat struct {
-	Update Date                 `json:"update"`
-	Vcnt   map[string]*VisitCnt `json:"site_info"` // Vcnt uses host as key
-	vcLock sync.RWMutex
+	Version int                  `json:"version"`
+	Update  Date                 `json:"update"`
+	Vcnt    map[string]*VisitCnt `json:"site_info"` // Vcnt uses host as key
+	vcLock  sync.RWMutex
 
 	// Whether a domain has blocked host. Used to avoid considering a domain as
 	// direct though it has blocked hosts.
 	hasBlockedHost map[string]bool
 	hbhLock        sync.RWMutex
+
+	// Domains marked in hasBlockedHost upon detecting temp blocked host, and
+	// when it's marked. Protected by hbhLock.
+	BlockedDomain map[string]Date `json:"blocked_domain,omitempty"`
+	// Only used in stat file to save temp blocked state of hosts.
+	TempBlockedOn map[string]time.Time `json:"temp_blocked,omitempty"`
+
+	// Pattern rules in user specified lists and imported lists, refer to
+	// siterule.go. Replaced upon reload.
+	userRules   []*siteRule
+	importRules []*siteRule
+	ruleLock    sync.RWMutex
+
+	// Learned stat of hosts replaced by rules in applyRules. Kept so it's
+	// still stored, and restored upon reload if the rule is removed.
+	// Protected by vcLock.
+	ruleShadowed map[string]*VisitCnt
 }
 
 func newSiteStat() *SiteStat {
 	return &SiteStat{
+		Version:        siteStatVersion,
 		Vcnt:           map[string]*VisitCnt{},
 		hasBlockedHost: map[string]bool{},
+		BlockedDomain:  map[string]Date{},
+		ruleShadowed:   map[string]*VisitCnt{},
 	}
 }
 
@@ -207,22 +320,27 @@ func (ss *SiteStat) TempBlocked(url *URL) {
 
 	vcnt := ss.get(url.Host)
 	if vcnt == nil {
-		panic("TempBlocked should always get existing visitCnt")
+		// Removed upon reloading site lists after the request started.
+		debug.Printf("%s not in site stat, maybe site lists reloaded\n", url.Host)
+		return
 	}
 	vcnt.tempBlocked()
 
 	// Mistakenly consider a partial blocked domain as direct will make that
 	// domain into PAC and never have a chance to correct the error.
 	// Once using blocked visit, a host is considered to maybe blocked even if
-	// it's block visit count decrease to 0. As hasBlockedHost is not saved,
-	// upon next start up of COW, the information will reflect the current
-	// status of that host.
+	// it's block visit count decrease to 0. The domain is saved in stat file
+	// for blockedDomainKeep, after that, upon next start up of COW, the
+	// information will reflect the current status of that host.
+	now := time.Now()
 	ss.hbhLock.RLock()
-	t := ss.hasBlockedHost[url.Domain]
+	// only need to update marked date once a day
+	t := time.Time(ss.BlockedDomain[url.Domain]).Format(dateLayout) == now.Format(dateLayout)
 	ss.hbhLock.RUnlock()
 	if !t {
 		ss.hbhLock.Lock()
 		ss.hasBlockedHost[url.Domain] = true
+		ss.BlockedDomain[url.Domain] = Date(now)
 		ss.hbhLock.Unlock()
 	}
 }
@@ -230,19 +348,35 @@ func (ss *SiteStat) TempBlocked(url *URL) {
 var alwaysDirectVisitCnt = newVisitCnt(userCnt, 0)
 
 func (ss *SiteStat) GetVisitCnt(url *URL) (vcnt *VisitCnt) {
-	if url.Domain == "" { // simple host or ip
-		return alwaysDirectVisitCnt
-	}
 	if vcnt = ss.get(url.Host); vcnt != nil {
 		return
 	}
-	if len(url.Domain) != len(url.Host) {
+	ss.ruleLock.RLock()
+	userRules, importRules := ss.userRules, ss.importRules
+	ss.ruleLock.RUnlock()
+	if vcnt = ss.createFromRule(url, userRules); vcnt != nil {
+		return
+	}
+	if url.Domain != "" && len(url.Domain) != len(url.Host) {
 		if vcnt = ss.get(url.Domain); vcnt != nil && vcnt.userSpecified() {
 			// if the domain is not specified by user, should create a new host
 			// visitCnt
 			return vcnt
 		}
 	}
+	// domain in site list may be written for old versions, which don't use
+	// Public Suffix List
+	if dm := host2OldDomain(url.Host); dm != url.Domain && len(dm) != len(url.Host) {
+		if vcnt = ss.get(dm); vcnt != nil && vcnt.userSpecified() {
+			return vcnt
+		}
+	}
+	if vcnt = ss.createFromRule(url, importRules); vcnt != nil {
+		return
+	}
+	if url.Domain == "" { // simple host or ip
+		return alwaysDirectVisitCnt
+	}
 	return ss.create(url.Host)
 }
 
@@ -252,53 +386,66 @@ func (ss *SiteStat) store(file string) (err error) {
 	}
 
 	now := time.Now()
-	var s *SiteStat
+	s := newSiteStat()
 	if ss.Update == Date(zeroTime) {
 		ss.Update = Date(time.Now())
 	}
+	ss.vcLock.RLock()
 	if now.Sub(time.Time(ss.Update)) > siteStaleThreshold {
 		// Not updated for a long time, don't drop any record
-		s = ss
+		for site, vcnt := range ss.Vcnt {
+			s.Vcnt[site] = vcnt
+		}
 		// Changing update time too fast will also drop useful record
-		s.Update = Date(time.Time(ss.Update).Add(siteStaleThreshold / 2))
-		if time.Time(s.Update).After(now) {
-			s.Update = Date(now)
+		ss.Update = Date(time.Time(ss.Update).Add(siteStaleThreshold / 2))
+		if time.Time(ss.Update).After(now) {
+			ss.Update = Date(now)
 		}
+		s.Update = ss.Update
 	} else {
-		s = newSiteStat()
 		s.Update = Date(now)
-		ss.vcLock.RLock()
 		for site, vcnt := range ss.Vcnt {
 			// user specified sites may change, always filter them out
-			dmcnt := ss.get(host2Domain(site))
+			dmcnt := ss.Vcnt[host2Domain(site)]
 			if (dmcnt != nil && dmcnt.userSpecified()) || vcnt.shouldDrop() {
 				continue
 			}
 			s.Vcnt[site] = vcnt
 		}
-		ss.vcLock.RUnlock()
 	}
+	for site, vcnt := range ss.ruleShadowed {
+		if !vcnt.shouldDrop() {
+			s.Vcnt[site] = vcnt
+		}
+	}
+	s.TempBlockedOn = make(map[string]time.Time)
+	for site, vcnt := range ss.Vcnt {
+		if !vcnt.userSpecified() && vcnt.AsTempBlocked() {
+			s.TempBlockedOn[site] = vcnt.blockedOn
+		}
+	}
+	ss.hbhLock.RLock()
+	for domain, d := range ss.BlockedDomain {
+		if now.Sub(time.Time(d)) < blockedDomainKeep {
+			s.BlockedDomain[domain] = d
+		}
+	}
+	ss.hbhLock.RUnlock()
 
 	b, err := json.MarshalIndent(s, "", "\t")
+	ss.vcLock.RUnlock()
 	if err != nil {
 		errl.Println("Error marshalling site stat:", err)
 		panic("internal error: error marshalling site")
 	}
 
-	f, err := os.Create(file)
-	if err != nil {
-		errl.Println("Can't create stat file:", err)
-		return
-	}
-	defer f.Close()
-	if _, err = f.Write(b); err != nil {
+	if err = writeFileRotate(file, b, siteStatBackupCnt); err != nil {
 		errl.Println("Error writing stat file:", err)
-		return
 	}
 	return
 }
 
-func (ss *SiteStat) loadList(lst []string, direct, blocked vcntint) {
+func (ss *SiteStat) loadList(lst []string, direct, blocked vscore) {
 	for _, d := range lst {
 		ss.Vcnt[d] = newVisitCntWithTime(direct, blocked, zeroTime)
 	}
@@ -310,26 +457,110 @@ func (ss *SiteStat) loadBuiltinList() {
 }
 
 func (ss *SiteStat) loadUserList() {
+	var directRules, blockedRules []*siteRule
 	if directList, err := loadSiteList(dsFile.alwaysDirect); err == nil {
-		ss.loadList(directList, userCnt, 0)
+		var plain []string
+		directRules, plain = parseRuleList(directList, dsFile.alwaysDirect, false)
+		ss.loadList(plain, userCnt, 0)
 	}
 	if blockedList, err := loadSiteList(dsFile.alwaysBlocked); err == nil {
-		ss.loadList(blockedList, 0, userCnt)
+		var plain []string
+		blockedRules, plain = parseRuleList(blockedList, dsFile.alwaysBlocked, true)
+		ss.loadList(plain, 0, userCnt)
+	}
+	ss.userRules = append(blockedRules, directRules...)
+	ss.importRules = loadGFWLists(rconfig().GFWList)
+}
+
+// migrate converts stat loaded from older version of stat file.
+func (ss *SiteStat) migrate() error {
+	if ss.Version > siteStatVersion {
+		return fmt.Errorf("stat file version %d is not supported, please upgrade COW", ss.Version)
+	}
+	if ss.Version == 0 {
+		ss.Version = 1
+	}
+	for ss.Version < siteStatVersion {
+		switch ss.Version {
+		case 1:
+			// Only adds blocked domain and temp blocked state, nothing to
+			// convert.
+		case 2:
+			// Visit count becomes score at recent date, which then decays.
+			// If both are visited, only the one decided by count difference
+			// as in version 2 is at recent date, the other is a little
+			// earlier, so the learned decision is kept. Sites not decided
+			// were taken as once blocked, so blocked visit is made later.
+			const v2DirectDelta = 20
+			for _, vc := range ss.Vcnt {
+				if vc.Recent == nil {
+					continue
+				}
+				t := time.Time(*vc.Recent)
+				earlier := newVisitTime(t.Add(-time.Second))
+				switch {
+				case vc.Direct > 0 && vc.Blocked > 0:
+					if vc.Direct-vc.Blocked >= v2DirectDelta {
+						vc.LastDirect, vc.LastBlocked = newVisitTime(t), earlier
+					} else {
+						vc.LastBlocked, vc.LastDirect = newVisitTime(t), earlier
+					}
+				case vc.Direct > 0:
+					vc.LastDirect = newVisitTime(t)
+				case vc.Blocked > 0:
+					vc.LastBlocked = newVisitTime(t)
+				}
+				vc.Recent = nil
+			}
+		}
+		ss.Version++
 	}
+	return nil
 }
 
-func (ss *SiteStat) load(file string) (err error) {
-	defer func() {
-		// load builtin list first, so user list can override builtin
-		ss.loadBuiltinList()
-		ss.loadUserList()
-		for host, vcnt := range ss.Vcnt {
-			if vcnt.OnceBlocked() {
-				ss.hasBlockedHost[host2Domain(host)] = true
-			}
+// restoreBlocked restores temp blocked state and blocked domains saved in
+// stat file.
+func (ss *SiteStat) restoreBlocked() {
+	now := time.Now()
+	for host, t := range ss.TempBlockedOn {
+		if now.Sub(t) >= tmpBlockedTimeout {
+			continue
 		}
-	}()
-	var exists bool
+		vcnt, ok := ss.Vcnt[host]
+		if !ok {
+			vcnt = newVisitCnt(0, 0)
+			ss.Vcnt[host] = vcnt
+		}
+		if !vcnt.userSpecified() {
+			vcnt.blockedOn = t
+		}
+	}
+	ss.TempBlockedOn = nil
+
+	if ss.BlockedDomain == nil {
+		ss.BlockedDomain = make(map[string]Date)
+	}
+	for domain, d := range ss.BlockedDomain {
+		if now.Sub(time.Time(d)) >= blockedDomainKeep {
+			delete(ss.BlockedDomain, domain)
+		}
+	}
+}
+
+func (ss *SiteStat) markBlockedHost() {
+	for host, vcnt := range ss.Vcnt {
+		if vcnt.OnceBlocked() {
+			ss.hasBlockedHost[host2Domain(host)] = true
+		}
+	}
+	for domain := range ss.BlockedDomain {
+		ss.hasBlockedHost[domain] = true
+	}
+}
+
+// loadFile loads stat file into ss. exists is false if the file doesn't
+// exist.
+func (ss *SiteStat) loadFile(file string) (exists bool, err error) {
 	if exists, err = isFileExists(file); err != nil {
 		fmt.Println("Error loading stat:", err)
 		return
@@ -337,29 +568,96 @@ func (ss *SiteStat) load(file string) (err error) {
 	if !exists {
 		return
 	}
-	var f *os.File
-	if f, err = os.Open(file); err != nil {
-		fmt.Printf("Error opening site stat %s: %v\n", file, err)
-		return
-	}
-	b, err := ioutil.ReadAll(f)
+	b, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Println("Error reading site stat:", err)
+		fmt.Printf("Error reading site stat %s: %v\n", file, err)
 		return
 	}
+	ss.Version = 0 // stat file may have no version field
 	if err = json.Unmarshal(b, ss); err != nil {
-		fmt.Println("Error decoding site stat:", err)
+		fmt.Printf("Error decoding site stat %s: %v\n", file, err)
 		return
 	}
+	if err = ss.migrate(); err != nil {
+		fmt.Printf("Error loading site stat %s: %v\n", file, err)
+	}
 	return
 }
 
+// load tries the stat file and then its backups in turn.
+func (ss *SiteStat) load(file string) (err error) {
+	defer func() {
+		// load builtin list first, so user list can override builtin
+		ss.loadBuiltinList()
+		ss.loadUserList()
+		ss.applyRules()
+		ss.markBlockedHost()
+	}()
+	for i := 0; i <= siteStatBackupCnt; i++ {
+		fpath := rotatedFileName(file, i)
+		ld := newSiteStat()
+		exists, lerr := ld.loadFile(fpath)
+		if !exists {
+			continue
+		}
+		if lerr != nil {
+			if err == nil {
+				err = lerr
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Println("Site stat loaded from backup", fpath)
+		}
+		ss.Update, ss.Vcnt = ld.Update, ld.Vcnt
+		ss.BlockedDomain, ss.TempBlockedOn = ld.BlockedDomain, ld.TempBlockedOn
+		ss.restoreBlocked()
+		return nil
+	}
+	return
+}
+
+// reloadUserList replaces user specified sites and rules with the content
+// of current lists. Learned stat is kept unless overridden by the lists.
+func (ss *SiteStat) reloadUserList() {
+	ns := newSiteStat()
+	ns.loadBuiltinList()
+	ns.loadUserList()
+
+	ss.vcLock.Lock()
+	for host, vcnt := range ss.Vcnt {
+		if vcnt.userSpecified() {
+			delete(ss.Vcnt, host)
+		}
+	}
+	// Rules are applied again below.
+	for host, vcnt := range ss.ruleShadowed {
+		ss.Vcnt[host] = vcnt
+	}
+	ss.ruleShadowed = make(map[string]*VisitCnt)
+	for host, vcnt := range ns.Vcnt {
+		ss.Vcnt[host] = vcnt
+	}
+	ss.ruleLock.Lock()
+	ss.userRules, ss.importRules = ns.userRules, ns.importRules
+	ss.ruleLock.Unlock()
+	ss.applyRules()
+
+	// Sites removed from blocked list should have chance to be direct, so
+	// recompute like on start up.
+	ss.hbhLock.Lock()
+	ss.hasBlockedHost = make(map[string]bool)
+	ss.markBlockedHost()
+	ss.hbhLock.Unlock()
+	ss.vcLock.Unlock()
+}
+
 func (ss *SiteStat) GetDirectList() []string {
 	lst := make([]string, 0)
 	// anyway to do more fine grained locking?
 	ss.vcLock.RLock()
 	for site, vc := range ss.Vcnt {
-		if ss.hasBlockedHost[host2Domain(site)] {
+		if ss.hasBlockedHost[host2Domain(site)] || hasParentRoute(site) {
 			continue
 		}
 		if vc.AsDirect() {
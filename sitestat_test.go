@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"time"
 )
@@ -77,7 +79,7 @@ func TestSiteStatLoadStore(t *testing.T) {
 		t.Fatalf("load error, %s not loaded\n", url1.Host)
 	}
 	if vc.Direct != 3 {
-		t.Errorf("load error, %s should have visit cnt 3, got: %d\n", url1.Host, vc.Direct)
+		t.Errorf("load error, %s should have visit cnt 3, got: %v\n", url1.Host, vc.Direct)
 	}
 
 	vc = ld.get(blockurl1.Host)
@@ -142,21 +144,21 @@ func TestSiteStatVisitCnt(t *testing.T) {
 		t.Fatalf("no VisitCnt for %s\n", g1.Host)
 	}
 	if vc.Direct != 30 {
-		t.Errorf("direct cnt for %s not correct, should be 30, got: %d\n", g1.Host, vc.Direct)
+		t.Errorf("direct cnt for %s not correct, should be 30, got: %v\n", g1.Host, vc.Direct)
 	}
 	if vc.Blocked != 0 {
-		t.Errorf("block cnt for %s not correct, should be 0 before blocked visit, got: %d\n", g1.Host, vc.Blocked)
+		t.Errorf("block cnt for %s not correct, should be 0 before blocked visit, got: %v\n", g1.Host, vc.Blocked)
 	}
-	if vc.rUpdated != true {
-		t.Errorf("VisitCnt lvUpdated should be true after visit")
+	if vc.LastDirect == 0 || vc.LastBlocked != 0 {
+		t.Errorf("VisitCnt last direct visit time should be updated after visit")
 	}
 
 	vc.BlockedVisit()
 	if vc.Blocked != 1 {
-		t.Errorf("blocked cnt for %s after 1 blocked visit should be 1, got: %d\n", g1.Host, vc.Blocked)
+		t.Errorf("blocked cnt for %s after 1 blocked visit should be 1, got: %v\n", g1.Host, vc.Blocked)
 	}
-	if vc.Direct != 0 {
-		t.Errorf("direct cnt for %s after 1 blocked visit should be 0, got: %d\n", g1.Host, vc.Direct)
+	if vc.Direct != 30 {
+		t.Errorf("direct cnt for %s after 1 blocked visit should not change, got: %v\n", g1.Host, vc.Direct)
 	}
 	if vc.AsDirect() {
 		t.Errorf("after blocked visit, a site should not be considered as direct\n")
@@ -172,14 +174,14 @@ func TestSiteStatVisitCnt(t *testing.T) {
 	}
 	si.BlockedVisit() // After temp blocked, update blocked visit count
 	if si.Blocked != 1 {
-		t.Errorf("blocked cnt for %s not correct, should be 1, got: %d\n", g4.Host, vc.Blocked)
+		t.Errorf("blocked cnt for %s not correct, should be 1, got: %v\n", g4.Host, vc.Blocked)
 	}
 	vc = ss.get(g4.Host)
 	if vc == nil {
 		t.Fatal("no VisitCnt for ", g4.Host)
 	}
 	if vc.Direct != 0 {
-		t.Errorf("direct cnt for %s not correct, should be 0, got: %d\n", g4.Host, vc.Direct)
+		t.Errorf("direct cnt for %s not correct, should be 0, got: %v\n", g4.Host, vc.Direct)
 	}
 	if !ss.hasBlockedHost[g4.Domain] {
 		t.Errorf("direct domain %s should have blocked host after blocked visit\n", g4.Domain)
@@ -241,6 +243,23 @@ func TestSiteStatGetVisitCnt(t *testing.T) {
 		t.Errorf("%s should onceBlocked\n", tw.Host)
 	}
 
+	// site list entries written for old versions
+	ss.Vcnt["github.io"] = newVisitCnt(0, userCnt)
+	gh, _ := ParseRequestURI("foo.github.io")
+	if !ss.GetVisitCnt(gh).AlwaysBlocked() {
+		t.Errorf("%s should match old domain github.io\n", gh.Host)
+	}
+	ss.Vcnt["blogspot.com.br"] = newVisitCnt(userCnt, 0)
+	bs, _ := ParseRequestURI("www.x.blogspot.com.br")
+	if !ss.GetVisitCnt(bs).AlwaysDirect() {
+		t.Errorf("%s should match old domain blogspot.com.br\n", bs.Host)
+	}
+	ss.Vcnt["appspot.com"] = newVisitCnt(0, 10)
+	ld, _ := ParseRequestURI("foo.appspot.com")
+	if ss.GetVisitCnt(ld) == ss.get("appspot.com") {
+		t.Errorf("%s should not match old domain not user specified\n", ld.Host)
+	}
+
 	g1, _ := ParseRequestURI("www.shoulddirect.com")
 	si = ss.GetVisitCnt(g1)
 	if si.AsBlocked() || si.AsDirect() || si.AsTempBlocked() {
@@ -251,12 +270,13 @@ func TestSiteStatGetVisitCnt(t *testing.T) {
 	if si.AsDirect() || si.AsBlocked() || si.AsTempBlocked() {
 		t.Errorf("%s visited only once, should still return unknow visit method\n", g1.Host)
 	}
-	for i := 0; i < directDelta; i++ {
+	const directCnt = 20 // enough to reach directConfidence
+	for i := 1; i < directCnt; i++ {
 		si.DirectVisit()
 	}
 	si = ss.GetVisitCnt(g1)
 	if !si.AsDirect() {
-		t.Errorf("%s direct %d times, should use direct visit\n", g1.Host, directDelta+1)
+		t.Errorf("%s direct %d times, should use direct visit\n", g1.Host, directCnt)
 	}
 	if si.OnceBlocked() {
 		t.Errorf("%s has not blocked visit, should not has once blocked\n", g1.Host)
@@ -267,3 +287,181 @@ func TestSiteStatGetVisitCnt(t *testing.T) {
 		t.Errorf("%s has one blocked visit, should has once blocked\n", g1.Host)
 	}
 }
+
+func TestSiteStatStoreRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stfile := path.Join(dir, "stat")
+
+	ss := newSiteStat()
+	url, _ := ParseRequestURI("www.foobar.com")
+	vcnt := ss.GetVisitCnt(url)
+	for i := 0; i < siteStatBackupCnt+2; i++ {
+		vcnt.DirectVisit()
+		if err := ss.store(stfile); err != nil {
+			t.Fatal("store error:", err)
+		}
+	}
+	for i := 0; i <= siteStatBackupCnt; i++ {
+		if exists, _ := isFileExists(rotatedFileName(stfile, i)); !exists {
+			t.Errorf("%s should exist\n", rotatedFileName(stfile, i))
+		}
+	}
+	for _, f := range []string{rotatedFileName(stfile, siteStatBackupCnt+1), stfile + ".tmp"} {
+		if exists, _ := isFileExists(f); exists {
+			t.Errorf("%s should not exist\n", f)
+		}
+	}
+
+	// corrupted stat file, should load from latest backup
+	ioutil.WriteFile(stfile, []byte(`{"update": "2013-`), 0644)
+	ld := newSiteStat()
+	if err := ld.load(stfile); err != nil {
+		t.Fatal("should load from backup, got error:", err)
+	}
+	if vc := ld.get(url.Host); vc == nil || int(vc.Direct) != siteStatBackupCnt+1 {
+		t.Error("stat in latest backup should be loaded, got", vc)
+	}
+
+	for i := 1; i <= siteStatBackupCnt; i++ {
+		os.Remove(rotatedFileName(stfile, i))
+	}
+	if err := newSiteStat().load(stfile); err == nil {
+		t.Error("corrupted stat file without backup should report error")
+	}
+}
+
+func TestSiteStatVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stfile := path.Join(dir, "stat")
+
+	today := time.Now().Format(dateLayout)
+	v1 := `{"update": "` + today + `", "site_info": {
+		"www.foobar.com": {"direct": 3, "block": 0, "recent": "` + today + `"}}}`
+	ioutil.WriteFile(stfile, []byte(v1), 0644)
+	ss := newSiteStat()
+	if err := ss.load(stfile); err != nil {
+		t.Fatal("load version 1 stat error:", err)
+	}
+	if ss.Version != siteStatVersion {
+		t.Error("stat should be migrated to current version, got", ss.Version)
+	}
+	if vc := ss.get("www.foobar.com"); vc == nil || vc.Direct != 3 || vc.LastBlocked != 0 ||
+		vc.LastDirect.Time().Format(dateLayout) != today || vc.Recent != nil {
+		t.Error("version 1 stat not migrated, got", vc)
+	}
+
+	// version 2 stat with both direct and blocked visits
+	v2 := `{"version": 2, "update": "` + today + `", "site_info": {
+		"direct.example.com": {"direct": 30, "block": 2, "recent": "` + today + `"},
+		"blocked.example.com": {"direct": 1, "block": 30, "recent": "` + today + `"},
+		"unsure.example.com": {"direct": 5, "block": 5, "recent": "` + today + `"}}}`
+	ioutil.WriteFile(stfile, []byte(v2), 0644)
+	ss = newSiteStat()
+	if err := ss.load(stfile); err != nil {
+		t.Fatal("load version 2 stat error:", err)
+	}
+	if vc := ss.get("direct.example.com"); vc == nil || vc.LastDirect <= vc.LastBlocked ||
+		vc.LastDirect.Time().Format(dateLayout) != today || vc.OnceBlocked() {
+		t.Error("version 2 direct site should keep direct as latest visit, got", vc)
+	}
+	if vc := ss.get("blocked.example.com"); vc == nil || vc.LastBlocked <= vc.LastDirect ||
+		vc.LastBlocked.Time().Format(dateLayout) != today || !vc.OnceBlocked() {
+		t.Error("version 2 blocked site should keep blocked as latest visit, got", vc)
+	}
+	if vc := ss.get("unsure.example.com"); vc == nil || vc.AsDirect() || !vc.OnceBlocked() {
+		t.Error("version 2 undecided site should be once blocked, got", vc)
+	}
+
+	ioutil.WriteFile(stfile, []byte(`{"version": 100, "site_info": {}}`), 0644)
+	if err := newSiteStat().load(stfile); err == nil {
+		t.Error("stat file with newer version should report error")
+	}
+}
+
+func TestSiteStatStoreBlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stfile := path.Join(dir, "stat")
+
+	ss := newSiteStat()
+	url, _ := ParseRequestURI("www.tempblocked.com")
+	ss.GetVisitCnt(url)
+	ss.TempBlocked(url)
+	ss.BlockedDomain["old.com"] = Date(time.Now().Add(-blockedDomainKeep - time.Hour))
+	if err := ss.store(stfile); err != nil {
+		t.Fatal("store error:", err)
+	}
+
+	ld := newSiteStat()
+	if err := ld.load(stfile); err != nil {
+		t.Fatal("load stat error:", err)
+	}
+	if vc := ld.get(url.Host); vc == nil || !vc.AsTempBlocked() {
+		t.Error("temp blocked state should be restored, got", vc)
+	}
+	if !ld.hasBlockedHost[url.Domain] {
+		t.Error("domain with temp blocked host should be restored")
+	}
+	if ld.hasBlockedHost["old.com"] {
+		t.Error("blocked domain marked long ago should be dropped")
+	}
+}
+
+func TestVisitCntDecay(t *testing.T) {
+	halfLife := config.VisitHalfLife
+	now := time.Now()
+
+	vc := newVisitCntWithTime(0, 10, now.Add(-2*halfLife))
+	if s := vc.Blocked.decay(vc.LastBlocked, now); s < 2.49 || s > 2.51 {
+		t.Error("score should be halved after each half-life, got", s)
+	}
+	if conf := vc.confidence(vc.Blocked, vc.LastBlocked); conf >= blockedConfidence {
+		t.Error("site blocked long ago should have low confidence, got", conf)
+	}
+	if vc.AsBlocked() {
+		t.Error("site blocked long ago should not be considered as blocked")
+	}
+	if !vc.OnceBlocked() {
+		t.Error("site without direct visit after blocked visit should be once blocked")
+	}
+
+	vc = newVisitCnt(0, 10)
+	if conf := vc.confidence(vc.Blocked, vc.LastBlocked); conf < blockedConfidence {
+		t.Error("site blocked recently should have high confidence, got", conf)
+	}
+	vc.DirectVisit()
+	if vc.AsBlocked() || vc.OnceBlocked() {
+		t.Error("site should not be blocked after direct visit")
+	}
+
+	vc = newVisitCntWithTime(30, 0, now.Add(-halfLife))
+	if vc.AsDirect() {
+		t.Error("direct score should decay")
+	}
+	for i := 0; i < 5; i++ {
+		vc.DirectVisit()
+	}
+	if !vc.AsDirect() {
+		t.Errorf("recent direct visits should make site direct, got %+v\n", vc)
+	}
+
+	vc = newVisitCntWithTime(1, 0, now.Add(-siteStaleThreshold-time.Hour))
+	if !vc.shouldDrop() {
+		t.Error("site not visited for long should be dropped")
+	}
+	vc = newVisitCntWithTime(maxScore, 0, now.Add(-siteStaleThreshold-time.Hour))
+	if vc.shouldDrop() {
+		t.Error("site with high score should not be dropped")
+	}
+}
@@ -6,10 +6,31 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 )
 
 // For socks documentation, refer to rfc 1928 http://www.ietf.org/rfc/rfc1928.txt
 
+const (
+	socksVer5 = 5
+
+	socksAuthNone         = 0
+	socksAuthUserPasswd   = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded        = 0
+	socksRepGeneralFailure   = 1
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
 var socksError = [...]string{
 	1: "General SOCKS server failure",
 	2: "Connection not allowed by ruleset",
@@ -30,17 +51,61 @@ var socksMsgVerMethodSelection = []byte{
 	0,   // no authorization required
 }
 
+// Used if socksUserPasswd is specified.
+var socksMsgVerMethodSelectionAuth = []byte{
+	0x5, // version 5
+	2,   // n method
+	0,   // no authorization required
+	2,   // username/password
+}
+
+// socksParent is a SOCKS5 parent proxy. userPasswd is used for rfc 1929
+// authentication if not empty.
+type socksParent struct {
+	ParentProxyStats
+	server     string
+	userPasswd string
+}
+
+var socksParents []*socksParent
+
+func init() {
+	RegisterParentProxy("socks5", func(server, userPasswd string) (ParentProxy, error) {
+		if userPasswd != "" && !isSocksUserPasswdValid(userPasswd) {
+			return nil, errors.New("username and password should be user:passwd, " +
+				"at most 255 bytes each")
+		}
+		sp := newSocksParent(server)
+		sp.userPasswd = userPasswd
+		return sp, nil
+	})
+}
+
+func newSocksParent(server string) *socksParent {
+	sp := &socksParent{server: server}
+	socksParents = append(socksParents, sp)
+	return sp
+}
+
+func (sp *socksParent) Name() string {
+	return "socks5 " + sp.server
+}
+
+func (sp *socksParent) Close() error {
+	return nil
+}
+
 func initSocksServer() {
-	if config.SocksParent != "" {
-		debug.Println("has socks server:", config.SocksParent)
+	for _, sp := range socksParents {
+		debug.Println("has socks server:", sp.server)
 	}
 }
 
-func createctSocksConnection(url *URL) (cn conn, err error) {
-	c, err := net.Dial("tcp", config.SocksParent)
+func (sp *socksParent) Dial(url *URL) (cn conn, err error) {
+	c, err := net.Dial("tcp", sp.server)
 	if err != nil {
 		errl.Printf("can't connect to socks server %s for %s: %v\n",
-			config.SocksParent, url.HostPort, err)
+			sp.server, url.HostPort, err)
 		return
 	}
 	hasErr := false
@@ -51,7 +116,11 @@ func createctSocksConnection(url *URL) (cn conn, err error) {
 	}()
 
 	var n int
-	if n, err = c.Write(socksMsgVerMethodSelection); n != 3 || err != nil {
+	methodMsg := socksMsgVerMethodSelection
+	if sp.userPasswd != "" {
+		methodMsg = socksMsgVerMethodSelectionAuth
+	}
+	if n, err = c.Write(methodMsg); n != len(methodMsg) || err != nil {
 		errl.Printf("sending ver/method selection msg %v n = %v\n", err, n)
 		hasErr = true
 		return
@@ -59,17 +128,23 @@ func createctSocksConnection(url *URL) (cn conn, err error) {
 
 	// version/method selection
 	repBuf := make([]byte, 2)
-	_, err = c.Read(repBuf)
-	if err != nil {
+	if _, err = io.ReadFull(c, repBuf); err != nil {
 		errl.Printf("read ver/method selection error %v\n", err)
 		hasErr = true
 		return
 	}
-	if repBuf[0] != 5 || repBuf[1] != 0 {
-		errl.Printf("socks ver/method selection reply error ver %d method %d",
+	if repBuf[0] != socksVer5 || (repBuf[1] != socksAuthNone &&
+		(repBuf[1] != socksAuthUserPasswd || sp.userPasswd == "")) {
+		errl.Printf("socks ver/method selection reply error ver %d method %d\n",
 			repBuf[0], repBuf[1])
 		hasErr = true
-		return
+		return zeroConn, socksProtocolErr
+	}
+	if repBuf[1] == socksAuthUserPasswd {
+		if err = sp.auth(c); err != nil {
+			hasErr = true
+			return
+		}
 	}
 	// debug.Println("Socks version selection done")
 
@@ -82,16 +157,30 @@ func createctSocksConnection(url *URL) (cn conn, err error) {
 		return
 	}
 
-	hostLen := len(host)
-	bufLen := 5 + hostLen + 2 // last 2 is port
-	reqBuf := make([]byte, bufLen)
-	reqBuf[0] = 5 // version 5
-	reqBuf[1] = 1 // cmd: connect
+	// Use IP address type for IP host, socks server may not accept IP
+	// address as domain name, especially IPv6 address.
+	var atyp byte = socksAtypDomain
+	addr := []byte(host)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			atyp, addr = socksAtypIPv4, ip4
+		} else {
+			atyp, addr = socksAtypIPv6, ip
+		}
+	}
+
+	reqBuf := make([]byte, 4, 5+len(addr)+2) // last 2 is port
+	reqBuf[0] = socksVer5
+	reqBuf[1] = socksCmdConnect
 	// reqBuf[2] = 0 // rsv: set to 0 when initializing
-	reqBuf[3] = 3 // atyp: domain name
-	reqBuf[4] = byte(hostLen)
-	copy(reqBuf[5:], host)
-	binary.BigEndian.PutUint16(reqBuf[5+hostLen:5+hostLen+2], uint16(port))
+	reqBuf[3] = atyp
+	if atyp == socksAtypDomain {
+		reqBuf = append(reqBuf, byte(len(addr)))
+	}
+	reqBuf = append(reqBuf, addr...)
+	reqBuf = append(reqBuf, 0, 0)
+	bufLen := len(reqBuf)
+	binary.BigEndian.PutUint16(reqBuf[bufLen-2:], uint16(port))
 
 	/*
 		if debug {
@@ -105,10 +194,10 @@ func createctSocksConnection(url *URL) (cn conn, err error) {
 		return
 	}
 
-	// I'm not clear why the buffer is fixed at 10. The rfc document does not say this.
-	// Polipo set this to 10 and I also observed the reply is always 10.
-	replyBuf := make([]byte, 10)
-	if n, err = c.Read(replyBuf); err != nil {
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	// BND.ADDR is at most 255 bytes domain name with 1 byte length.
+	replyBuf := make([]byte, 4+1+255+2)
+	if n, err = io.ReadFull(c, replyBuf[:4]); err != nil {
 		// Seems that socks server will close connection if it can't find host
 		if err != io.EOF {
 			errl.Printf("read socks reply err %v n %d\n", err, n)
@@ -118,23 +207,73 @@ func createctSocksConnection(url *URL) (cn conn, err error) {
 	}
 	// debug.Printf("Socks reply length %d\n", n)
 
-	if replyBuf[0] != 5 {
+	if replyBuf[0] != socksVer5 {
 		errl.Printf("socks reply connect %s VER %d not supported\n", url.HostPort, replyBuf[0])
 		hasErr = true
 		return zeroConn, socksProtocolErr
 	}
-	if replyBuf[1] != 0 {
+	if replyBuf[1] != socksRepSucceeded {
 		errl.Printf("socks reply connect %s error %s\n", url.HostPort, socksError[replyBuf[1]])
 		hasErr = true
 		return zeroConn, socksProtocolErr
 	}
-	if replyBuf[3] != 1 {
+	var bndLen int
+	switch replyBuf[3] {
+	case socksAtypIPv4:
+		bndLen = net.IPv4len
+	case socksAtypIPv6:
+		bndLen = net.IPv6len
+	case socksAtypDomain:
+		if _, err = io.ReadFull(c, replyBuf[4:5]); err != nil {
+			errl.Printf("read socks reply bind address err %v\n", err)
+			hasErr = true
+			return
+		}
+		bndLen = int(replyBuf[4])
+	default:
 		errl.Printf("socks reply connect %s ATYP %d\n", url.HostPort, replyBuf[3])
 		hasErr = true
 		return zeroConn, socksProtocolErr
 	}
+	// bind address is not used for CONNECT
+	if _, err = io.ReadFull(c, replyBuf[:bndLen+2]); err != nil {
+		errl.Printf("read socks reply bind address err %v\n", err)
+		hasErr = true
+		return
+	}
 
-	debug.Println("connected to:", url.HostPort, "via socks server")
+	debug.Println("connected to:", url.HostPort, "via socks server:", sp.server)
 	// Now the socket can be used to pass data.
-	return conn{c, ctSocksConn}, nil
+	return conn{c, ctSocksConn, sp}, nil
+}
+
+// Username/password authentication with socks parent proxy, refer to rfc 1929.
+func (sp *socksParent) auth(c net.Conn) (err error) {
+	// length is checked when parsing config
+	arr := strings.SplitN(sp.userPasswd, ":", 2)
+	user, passwd := arr[0], arr[1]
+
+	// VER ULEN UNAME PLEN PASSWD
+	reqBuf := make([]byte, 0, 3+len(user)+len(passwd))
+	reqBuf = append(reqBuf, 1, byte(len(user)))
+	reqBuf = append(reqBuf, user...)
+	reqBuf = append(reqBuf, byte(len(passwd)))
+	reqBuf = append(reqBuf, passwd...)
+	if _, err = c.Write(reqBuf); err != nil {
+		errl.Printf("sending socks username/password err %v\n", err)
+		return
+	}
+
+	// VER STATUS
+	repBuf := make([]byte, 2)
+	if _, err = io.ReadFull(c, repBuf); err != nil {
+		errl.Printf("read socks auth reply err %v\n", err)
+		return
+	}
+	if repBuf[0] != 1 || repBuf[1] != 0 {
+		errl.Printf("socks parent %s auth failed ver %d status %d\n",
+			sp.server, repBuf[0], repBuf[1])
+		return errSocksAuthFailed
+	}
+	return
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 server. Only CONNECT command is supported. Requests from SOCKS
+// clients are handled the same way as HTTP CONNECT requests, so blocked site
+// detection and site statistics are shared with the HTTP proxy.
+
+type SocksProxy struct {
+	addr string // listen address, contains port
+}
+
+func NewSocksProxy(addr string) *SocksProxy {
+	return &SocksProxy{addr: addr}
+}
+
+func (py *SocksProxy) Serve(done chan byte) {
+	defer func() {
+		done <- 1
+	}()
+	ln, err := net.Listen("tcp", py.addr)
+	if err != nil {
+		fmt.Println("Server creation failed:", err)
+		return
+	}
+	info.Printf("COW socks5 proxy address %s\n", py.addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			debug.Println("socks client connection:", err)
+			continue
+		}
+		if debug {
+			debug.Println("new socks client:", conn.RemoteAddr())
+		}
+		c := newClientConn(conn, nil)
+		c.socks = true
+		go c.serveSocks()
+	}
+}
+
+var errSocksAuthFailed = errors.New("socks authentication failed")
+
+func (c *clientConn) serveSocks() {
+	var r Request
+	defer func() {
+		r.releaseBuf()
+		c.Close()
+	}()
+
+	setConnReadTimeout(c, clientConnTimeout, "socks handshake")
+	if err := c.socksHandshake(&r); err != nil {
+		if debug {
+			debug.Printf("%s socks handshake: %v\n", c.RemoteAddr(), err)
+		}
+		return
+	}
+	unsetConnReadTimeout(c, "socks handshake")
+	if dbgRq {
+		dbgRq.Printf("socks request from client %s: %s\n", c.RemoteAddr(), &r)
+	}
+	c.serveConnect(&r)
+}
+
+// socksHandshake does method selection and authentication, then reads the
+// client's request into r.
+func (c *clientConn) socksHandshake(r *Request) (err error) {
+	if err = c.socksAuth(); err != nil {
+		return
+	}
+	url, rep, err := c.readSocksRequest()
+	if err != nil {
+		if rep != socksRepSucceeded {
+			sendSocksReply(c, rep)
+		}
+		return
+	}
+	r.initConnect(url)
+	return
+}
+
+func (c *clientConn) socksAuth() (err error) {
+	// VER NMETHODS METHODS
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(c.bufRd, buf); err != nil {
+		return
+	}
+	if buf[0] != socksVer5 {
+		errl.Printf("%s socks version %d not supported\n", c.RemoteAddr(), buf[0])
+		return socksProtocolErr
+	}
+	methods := make([]byte, buf[1])
+	if _, err = io.ReadFull(c.bufRd, methods); err != nil {
+		return
+	}
+
+	method := c.socksAuthMethod(methods)
+	if _, err = c.Write([]byte{socksVer5, method}); err != nil {
+		return
+	}
+	switch method {
+	case socksAuthNoAcceptable:
+		return errSocksAuthFailed
+	case socksAuthUserPasswd:
+		return c.socksAuthUserPasswd()
+	}
+	return
+}
+
+// socksAuthMethod selects authentication method for the client. Clients in
+// allowedClient or already authenticated need no authentication.
+func (c *clientConn) socksAuthMethod(methods []byte) byte {
+	var need byte = socksAuthNone
+	if auth.required {
+		clientIP, _ := splitHostPort(c.RemoteAddr().String())
+		if !auth.authed.has(clientIP) && !authIP(clientIP) {
+			if auth.user == "" {
+				return socksAuthNoAcceptable
+			}
+			need = socksAuthUserPasswd
+		}
+	}
+	if bytes.IndexByte(methods, need) == -1 {
+		return socksAuthNoAcceptable
+	}
+	return need
+}
+
+// Username/password authentication for SOCKS5, refer to rfc 1929.
+func (c *clientConn) socksAuthUserPasswd() (err error) {
+	// VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(c.bufRd, buf); err != nil {
+		return
+	}
+	if buf[0] != 1 {
+		errl.Printf("%s socks auth version %d not supported\n", c.RemoteAddr(), buf[0])
+		return socksProtocolErr
+	}
+	user := make([]byte, buf[1])
+	if _, err = io.ReadFull(c.bufRd, user); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(c.bufRd, buf[:1]); err != nil {
+		return
+	}
+	passwd := make([]byte, buf[0])
+	if _, err = io.ReadFull(c.bufRd, passwd); err != nil {
+		return
+	}
+
+	var status byte
+	if string(user) != auth.user || string(passwd) != auth.passwd {
+		errl.Printf("socks auth: %s username or password wrong\n", c.RemoteAddr())
+		status = 1
+	}
+	if _, err = c.Write([]byte{1, status}); err != nil {
+		return
+	}
+	if status != 0 {
+		return errSocksAuthFailed
+	}
+	clientIP, _ := splitHostPort(c.RemoteAddr().String())
+	auth.authed.add(clientIP)
+	return
+}
+
+// readSocksRequest returns the requested address. If there's error, rep is
+// the reply code that should be sent back to client.
+func (c *clientConn) readSocksRequest() (url *URL, rep byte, err error) {
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(c.bufRd, buf); err != nil {
+		return
+	}
+	if buf[0] != socksVer5 {
+		errl.Printf("%s socks request version %d not supported\n", c.RemoteAddr(), buf[0])
+		return nil, socksRepGeneralFailure, socksProtocolErr
+	}
+	if buf[1] != socksCmdConnect {
+		errl.Printf("%s socks command %d not supported\n", c.RemoteAddr(), buf[1])
+		return nil, socksRepCmdNotSupported, errNotSupported
+	}
+
+	var host, domain string
+	switch buf[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if buf[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(c.bufRd, ip); err != nil {
+			return
+		}
+		// IP address has no domain, same as in ParseRequestURI
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		if _, err = io.ReadFull(c.bufRd, buf[:1]); err != nil {
+			return
+		}
+		name := make([]byte, buf[0])
+		if _, err = io.ReadFull(c.bufRd, name); err != nil {
+			return
+		}
+		host = string(name)
+		domain = host2Domain(host)
+	default:
+		errl.Printf("%s socks address type %d not supported\n", c.RemoteAddr(), buf[3])
+		return nil, socksRepAtypNotSupported, errNotSupported
+	}
+
+	if _, err = io.ReadFull(c.bufRd, buf[:2]); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))
+	return &URL{net.JoinHostPort(host, port), host, port, domain, ""}, socksRepSucceeded, nil
+}
+
+// sendSocksReply sends reply for CONNECT request. Bind address is not useful
+// for CONNECT, so always use 0.0.0.0:0.
+func sendSocksReply(w io.Writer, rep byte) (err error) {
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	_, err = w.Write([]byte{socksVer5, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return
+}
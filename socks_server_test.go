@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	var testData = []struct {
+		req []byte
+		url *URL
+	}{
+		{[]byte{5, 1, 0, 3, 9, 'w', 'w', 'w', '.', 'g', '.', 'c', 'o', 'm', 0x1, 0xbb},
+			&URL{"www.g.com:443", "www.g.com", "443", "g.com", ""}},
+		{[]byte{5, 1, 0, 1, 192, 168, 1, 1, 0x1f, 0x90},
+			&URL{"192.168.1.1:8080", "192.168.1.1", "8080", "", ""}},
+		{[]byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+			&URL{"[2001:db8::1]:80", "2001:db8::1", "80", "", ""}},
+	}
+
+	// other tests may have enabled authentication
+	authRequired := auth.required
+	auth.required = false
+	defer func() {
+		auth.required = authRequired
+	}()
+
+	for _, td := range testData {
+		cli, srv := net.Pipe()
+		c := newClientConn(srv, nil)
+		c.socks = true
+
+		go func() {
+			cli.Write([]byte{5, 1, socksAuthNone})
+			rep := make([]byte, 2)
+			io.ReadFull(cli, rep)
+			if !bytes.Equal(rep, []byte{5, socksAuthNone}) {
+				t.Errorf("method selection reply %v\n", rep)
+			}
+			cli.Write(td.req)
+		}()
+
+		var r Request
+		if err := c.socksHandshake(&r); err != nil {
+			t.Fatalf("socks handshake for %v error: %v\n", td.url, err)
+		}
+		if !r.isConnect || *r.URL != *td.url {
+			t.Errorf("socks request should be CONNECT %v, got %s %v\n", td.url, r.Method, r.URL)
+		}
+		r.releaseBuf()
+		cli.Close()
+		c.Close()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// socksTestServer accepts one connection, requires username/password
+// authentication and replies with the given bind address.
+func socksTestServer(t *testing.T, ln net.Listener, wantReq, bndAddr []byte) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 512)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		t.Error("socks server reading methods:", err)
+		return
+	}
+	methods := buf[2 : 2+buf[1]]
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		t.Error("socks server reading methods:", err)
+		return
+	}
+	if bytes.IndexByte(methods, socksAuthUserPasswd) == -1 {
+		t.Error("client does not offer username/password method:", methods)
+		return
+	}
+	conn.Write([]byte{socksVer5, socksAuthUserPasswd})
+
+	want := []byte{1, 4, 'u', 's', 'e', 'r', 6, 'p', 'a', 's', 's', 'w', 'd'}
+	if _, err = io.ReadFull(conn, buf[:len(want)]); err != nil {
+		t.Error("socks server reading auth:", err)
+		return
+	}
+	if !bytes.Equal(buf[:len(want)], want) {
+		t.Errorf("socks auth request %v, want %v\n", buf[:len(want)], want)
+	}
+	conn.Write([]byte{1, 0})
+
+	if _, err = io.ReadFull(conn, buf[:len(wantReq)]); err != nil {
+		t.Error("socks server reading request:", err)
+		return
+	}
+	if !bytes.Equal(buf[:len(wantReq)], wantReq) {
+		t.Errorf("socks request %v, want %v\n", buf[:len(wantReq)], wantReq)
+	}
+	reply := append([]byte{socksVer5, socksRepSucceeded, 0}, bndAddr...)
+	reply = append(reply, 0x1f, 0x90)
+	conn.Write(append(reply, "hello"...))
+}
+
+func TestCreateSocksConnection(t *testing.T) {
+	var testData = []struct {
+		url     *URL
+		req     []byte
+		bndAddr []byte // ATYP BND.ADDR
+	}{
+		{&URL{"www.g.com:443", "www.g.com", "443", "g.com", ""},
+			[]byte{5, 1, 0, 3, 9, 'w', 'w', 'w', '.', 'g', '.', 'c', 'o', 'm', 0x1, 0xbb},
+			[]byte{3, 5, 'p', '.', 'c', 'o', 'm'}},
+		{&URL{"[2001:db8::1]:80", "2001:db8::1", "80", "", ""},
+			[]byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+			[]byte{4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}},
+		{&URL{"192.168.1.1:8080", "192.168.1.1", "8080", "", ""},
+			[]byte{5, 1, 0, 1, 192, 168, 1, 1, 0x1f, 0x90},
+			[]byte{1, 10, 0, 0, 1}},
+	}
+
+	for _, td := range testData {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("listen:", err)
+		}
+		sp := &socksParent{server: ln.Addr().String(), userPasswd: "user:passwd"}
+		go socksTestServer(t, ln, td.req, td.bndAddr)
+
+		cn, err := sp.Dial(td.url)
+		if err != nil {
+			t.Errorf("socks connection to %s error: %v\n", td.url.HostPort, err)
+			ln.Close()
+			continue
+		}
+		// data after the reply should not be consumed
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(cn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("socks connection to %s read %q %v\n", td.url.HostPort, buf, err)
+		}
+		cn.Close()
+		ln.Close()
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
 	"net"
 	"os/exec"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -54,3 +60,279 @@ func runSSH() {
 		alreadyRunPrinted = false
 	}
 }
+
+// Native SSH parent proxy. Connections to web servers are created as
+// direct-tcpip channels on SSH connections, so there's no need for the ssh
+// command and a local socks server. Multiple channels share a single SSH
+// connection, new SSH connection is created if all existing ones are busy.
+
+const (
+	sshMaxChannel        = 16 // max concurrent channels on a SSH connection
+	sshKeepAliveInterval = 30 * time.Second
+	sshKeepAliveTimeout  = 15 * time.Second
+)
+
+// sshParent is an SSH server used as parent proxy.
+type sshParent struct {
+	ParentProxyStats
+	server string // host:port
+	user   string
+	passwd string // use public key authentication if empty
+	config *ssh.ClientConfig
+
+	sync.Mutex
+	clients []*sshClient
+}
+
+type sshClient struct {
+	*ssh.Client
+	nchannel int // protected by sshParent's lock
+}
+
+var sshParents []*sshParent
+
+func init() {
+	RegisterParentProxy("ssh", func(server, userPasswd string) (ParentProxy, error) {
+		if userPasswd == "" {
+			return nil, errors.New("should specify user for ssh")
+		}
+		arr := strings.SplitN(userPasswd, ":", 2)
+		var passwd string
+		if len(arr) == 2 {
+			passwd = arr[1]
+		}
+		return newSshParent(server, arr[0], passwd), nil
+	})
+}
+
+// ssh client config is initialized in initSSH, as options for ssh key may
+// come after proxy option.
+func newSshParent(server, user, passwd string) *sshParent {
+	sp := &sshParent{server: server, user: user, passwd: passwd}
+	sshParents = append(sshParents, sp)
+	return sp
+}
+
+func (sp *sshParent) Name() string {
+	return "ssh " + sp.server
+}
+
+// Close closes all SSH connections.
+func (sp *sshParent) Close() error {
+	sp.Lock()
+	clients := sp.clients
+	sp.clients = nil
+	sp.Unlock()
+	for _, cli := range clients {
+		cli.Close()
+	}
+	return nil
+}
+
+func initSSH() {
+	if len(sshParents) == 0 {
+		return
+	}
+	knownHosts := config.SshKnownHosts
+	if knownHosts == "" {
+		knownHosts = "~/.ssh/known_hosts"
+	}
+	hostKeyCallback, err := knownhosts.New(expandTilde(knownHosts))
+	if err != nil {
+		Fatal("loading ssh known hosts:", err)
+	}
+	signers := loadSshKeys()
+
+	for _, sp := range sshParents {
+		var auth []ssh.AuthMethod
+		if len(signers) > 0 {
+			auth = append(auth, ssh.PublicKeys(signers...))
+		}
+		if sp.passwd != "" {
+			auth = append(auth, ssh.Password(sp.passwd))
+		}
+		if len(auth) == 0 {
+			Fatal("no ssh key file or password for ssh server", sp.server)
+		}
+		sp.config = &ssh.ClientConfig{
+			User:            sp.user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dialTimeout.get(),
+		}
+		debug.Println("has ssh server:", sp.server)
+	}
+}
+
+// loadSshKeys loads private keys in sshKeyFile, or the default key files
+// used by ssh if not specified.
+func loadSshKeys() (signers []ssh.Signer) {
+	files := config.SshKeyFile
+	userSpecified := len(files) != 0
+	if !userSpecified {
+		files = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+	}
+	for _, f := range files {
+		pem, err := ioutil.ReadFile(expandTilde(f))
+		if err != nil {
+			if userSpecified {
+				Fatal("reading ssh key file:", err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			// Can't ask for passphrase, so encrypted key is not supported.
+			Fatalf("ssh key file %s: %v\n", f, err)
+		}
+		signers = append(signers, signer)
+	}
+	return
+}
+
+func (sp *sshParent) Dial(url *URL) (cn conn, err error) {
+	cli, err := sp.getClient()
+	if err != nil {
+		errl.Printf("can't connect to ssh server %s for %s: %v\n", sp.server, url.HostPort, err)
+		return zeroConn, err
+	}
+	c, err := cli.Dial("tcp", url.HostPort)
+	if err != nil {
+		sp.release(cli)
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			// Not rejected by server, the SSH connection maybe broken.
+			cli.Close()
+		}
+		errl.Printf("can't create ssh channel to %s via %s: %v\n", url.HostPort, sp.server, err)
+		return zeroConn, err
+	}
+	debug.Println("connected to:", url.HostPort, "via ssh server:", sp.server)
+	return conn{&sshConn{Conn: c, sp: sp, cli: cli}, ctSshConn, sp}, nil
+}
+
+// getClient returns a SSH connection which can open more channels, the
+// channel count of the returned connection is increased.
+func (sp *sshParent) getClient() (*sshClient, error) {
+	sp.Lock()
+	for _, cli := range sp.clients {
+		if cli.nchannel < sshMaxChannel {
+			cli.nchannel++
+			sp.Unlock()
+			return cli, nil
+		}
+	}
+	sp.Unlock()
+
+	cli, err := sp.dial()
+	if err != nil {
+		return nil, err
+	}
+	sp.Lock()
+	cli.nchannel++
+	sp.clients = append(sp.clients, cli)
+	sp.Unlock()
+	return cli, nil
+}
+
+func (sp *sshParent) release(cli *sshClient) {
+	sp.Lock()
+	cli.nchannel--
+	sp.Unlock()
+}
+
+func (sp *sshParent) remove(cli *sshClient) {
+	sp.Lock()
+	for i, c := range sp.clients {
+		if c == cli {
+			sp.clients = append(sp.clients[:i], sp.clients[i+1:]...)
+			break
+		}
+	}
+	sp.Unlock()
+}
+
+func (sp *sshParent) dial() (*sshClient, error) {
+	c, err := net.DialTimeout("tcp", sp.server, dialTimeout.get())
+	if err != nil {
+		return nil, err
+	}
+	// time out handshake
+	c.SetDeadline(time.Now().Add(dialTimeout.get()))
+	sc, chans, reqs, err := ssh.NewClientConn(c, sp.server, sp.config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(zeroTime)
+	cli := &sshClient{Client: ssh.NewClient(sc, chans, reqs)}
+	debug.Println("ssh connection established:", sp.server)
+	go sp.keepAlive(cli)
+	return cli, nil
+}
+
+// keepAlive sends keepalive request periodically, closes the SSH connection
+// if the server does not reply. Closed connection is removed from the
+// available ones.
+func (sp *sshParent) keepAlive(cli *sshClient) {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- cli.Wait()
+	}()
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-closed:
+			debug.Printf("ssh connection to %s closed: %v\n", sp.server, err)
+			sp.remove(cli)
+			return
+		case <-ticker.C:
+			replied := make(chan error, 1)
+			go func() {
+				_, _, err := cli.SendRequest("keepalive@openssh.com", true, nil)
+				replied <- err
+			}()
+			select {
+			case err := <-replied:
+				if err != nil {
+					errl.Printf("ssh %s keepalive: %v\n", sp.server, err)
+					cli.Close()
+				}
+			case <-time.After(sshKeepAliveTimeout):
+				errl.Printf("ssh %s keepalive timeout\n", sp.server)
+				cli.Close()
+			}
+		}
+	}
+}
+
+// sshConn is a direct-tcpip channel on a SSH connection.
+type sshConn struct {
+	net.Conn
+	sp     *sshParent
+	cli    *sshClient
+	closed sync.Once
+}
+
+func (c *sshConn) Close() error {
+	c.closed.Do(func() {
+		c.sp.release(c.cli)
+	})
+	return c.Conn.Close()
+}
+
+// SSH channel does not support deadline. Dead SSH connection is detected by
+// keepalive.
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTestSshSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("generating key:", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal("creating signer:", err)
+	}
+	return signer
+}
+
+// sshTestServer accepts direct-tcpip channels and echoes data back.
+func sshTestServer(t *testing.T, ln net.Listener, config *ssh.ServerConfig) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(c, config)
+			if err != nil {
+				t.Error("ssh server handshake:", err)
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				if nc.ChannelType() != "direct-tcpip" {
+					nc.Reject(ssh.UnknownChannelType, "not supported")
+					continue
+				}
+				var dst struct {
+					Host     string
+					Port     uint32
+					OrigHost string
+					OrigPort uint32
+				}
+				if err := ssh.Unmarshal(nc.ExtraData(), &dst); err != nil || dst.Host != "www.g.com" {
+					nc.Reject(ssh.ConnectionFailed, "bad destination")
+					continue
+				}
+				ch, reqs, err := nc.Accept()
+				if err != nil {
+					continue
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					io.Copy(ch, ch)
+					ch.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func TestSshParent(t *testing.T) {
+	hostKey := newTestSshSigner(t)
+	clientKey := newTestSshSigner(t)
+	clientPub := string(clientKey.PublicKey().Marshal())
+
+	srvConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "cow" && string(key.Marshal()) == clientPub {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	srvConfig.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen:", err)
+	}
+	defer ln.Close()
+	go sshTestServer(t, ln, srvConfig)
+
+	dir, err := ioutil.TempDir("", "cow-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostKey.PublicKey())
+	if err = ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		t.Fatal("loading known hosts:", err)
+	}
+
+	sp := &sshParent{server: ln.Addr().String(), user: "cow"}
+	sp.config = &ssh.ClientConfig{
+		User:            sp.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	url := &URL{"www.g.com:80", "www.g.com", "80", "g.com", ""}
+	var conns []conn
+	for i := 0; i < 3; i++ {
+		cn, err := sp.Dial(url)
+		if err != nil {
+			t.Fatal("ssh connect:", err)
+		}
+		defer cn.Close()
+		conns = append(conns, cn)
+	}
+	if len(sp.clients) != 1 || sp.clients[0].nchannel != 3 {
+		t.Error("channels should share one ssh connection")
+	}
+	for i, cn := range conns {
+		msg := "hello " + strconv.Itoa(i)
+		cn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(cn, buf); err != nil || string(buf) != msg {
+			t.Errorf("channel %d read %q %v\n", i, buf, err)
+		}
+	}
+	for _, cn := range conns {
+		cn.Close()
+	}
+	if sp.clients[0].nchannel != 0 {
+		t.Error("closed channel not released, channel count:", sp.clients[0].nchannel)
+	}
+
+	// channel rejected by server should not close the ssh connection
+	if _, err = sp.Dial(&URL{"www.f.com:80", "www.f.com", "80", "f.com", ""}); err == nil {
+		t.Error("rejected channel should return error")
+	}
+	if len(sp.clients) != 1 || sp.clients[0].nchannel != 0 {
+		t.Error("rejected channel should not affect ssh connection")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Minimal TLS record layer parsing, just enough to find out the server name
+// a client wants to connect, and whether the server has finished the
+// unencrypted part of handshake. For TLS details, refer to rfc 5246, rfc 6066
+// and rfc 8446.
+
+const (
+	tlsRecordHeaderLen        = 5
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordAlert            = 0x15
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+
+	tlsHandshakeClientHello = 1
+	tlsHandshakeServerHello = 2
+	tlsHandshakeCertificate = 11
+
+	tlsExtServerName  = 0
+	tlsServerNameHost = 0
+)
+
+var errTLSMalformed = errors.New("malformed TLS message")
+
+// tlsRecordLen returns the length of the TLS record's fragment. b should
+// contain at least the record header.
+func tlsRecordLen(b []byte) int {
+	return int(binary.BigEndian.Uint16(b[3:5]))
+}
+
+// parseClientHelloSNI returns the server name in the ClientHello contained
+// in the handshake record fragment b. Returns empty string if the client
+// does not send server name indication.
+func parseClientHelloSNI(b []byte) (sni string, err error) {
+	// msg_type(1) length(3) client_version(2) random(32)
+	if len(b) < 38 || b[0] != tlsHandshakeClientHello {
+		return "", errTLSMalformed
+	}
+	b = b[38:]
+
+	// session_id, cipher_suites, compression_methods
+	var ok bool
+	if b, ok = tlsSkipVector(b, 1); !ok {
+		return "", errTLSMalformed
+	}
+	if b, ok = tlsSkipVector(b, 2); !ok {
+		return "", errTLSMalformed
+	}
+	if b, ok = tlsSkipVector(b, 1); !ok {
+		return "", errTLSMalformed
+	}
+	if len(b) < 2 {
+		return "", nil // no extensions
+	}
+	extLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if extLen < len(b) {
+		b = b[:extLen]
+	}
+
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < n {
+			return "", errTLSMalformed
+		}
+		if extType != tlsExtServerName {
+			b = b[n:]
+			continue
+		}
+		// server_name_list length(2) name_type(1) host_name length(2)
+		ext := b[:n]
+		if len(ext) < 5 || ext[2] != tlsServerNameHost {
+			return "", errTLSMalformed
+		}
+		nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+nameLen {
+			return "", errTLSMalformed
+		}
+		return string(ext[5 : 5+nameLen]), nil
+	}
+	return "", nil
+}
+
+// tlsSkipVector skips a variable length vector whose length is encoded in
+// lenSize bytes.
+func tlsSkipVector(b []byte, lenSize int) ([]byte, bool) {
+	if len(b) < lenSize {
+		return nil, false
+	}
+	var n int
+	for i := 0; i < lenSize; i++ {
+		n = n<<8 | int(b[i])
+	}
+	b = b[lenSize:]
+	if len(b) < n {
+		return nil, false
+	}
+	return b[n:], true
+}
+
+// tlsServerHandshakeDone parses records sent by server in b, returns true if
+// both ServerHello and Certificate are received. For TLS 1.3 and session
+// resumption, certificate is not sent in plain text, so encrypted record
+// following ServerHello also counts. An alert from server also means the
+// server is reachable. Returns errTLSMalformed if b does not look like TLS
+// records, false and nil error if more data is needed.
+func tlsServerHandshakeDone(b []byte) (bool, error) {
+	var hs []byte // handshake messages may span records
+	sawHello := false
+	for len(b) >= tlsRecordHeaderLen {
+		if b[1] != 3 { // major version
+			return false, errTLSMalformed
+		}
+		n := tlsRecordHeaderLen + tlsRecordLen(b)
+		if len(b) < n {
+			break
+		}
+		switch b[0] {
+		case tlsRecordHandshake:
+			hs = append(hs, b[tlsRecordHeaderLen:n]...)
+			for len(hs) >= 4 {
+				msgLen := 4 + (int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]))
+				if len(hs) < msgLen {
+					break
+				}
+				switch hs[0] {
+				case tlsHandshakeServerHello:
+					sawHello = true
+				case tlsHandshakeCertificate:
+					if sawHello {
+						return true, nil
+					}
+				}
+				hs = hs[msgLen:]
+			}
+		case tlsRecordAlert:
+			return true, nil
+		case tlsRecordChangeCipherSpec, tlsRecordApplicationData:
+			if !sawHello {
+				return false, errTLSMalformed
+			}
+			return true, nil
+		default:
+			return false, errTLSMalformed
+		}
+		b = b[n:]
+	}
+	return false, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// readClientHello returns the first TLS record sent by a client using the
+// specified server name.
+func readClientHello(t *testing.T, serverName string) []byte {
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	go func() {
+		tc := tls.Client(cli, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		tc.Handshake() // will fail as srv closes
+		cli.Close()
+	}()
+
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(srv, header); err != nil {
+		t.Fatal("reading TLS record header:", err)
+	}
+	if header[0] != tlsRecordHandshake {
+		t.Fatal("first TLS record is not handshake:", header[0])
+	}
+	fragment := make([]byte, tlsRecordLen(header))
+	if _, err := io.ReadFull(srv, fragment); err != nil {
+		t.Fatal("reading TLS record:", err)
+	}
+	return fragment
+}
+
+func TestParseClientHelloSNI(t *testing.T) {
+	for _, name := range []string{"www.g.com", ""} {
+		sni, err := parseClientHelloSNI(readClientHello(t, name))
+		if err != nil {
+			t.Errorf("parse ClientHello with server name %q error: %v\n", name, err)
+		}
+		if sni != name {
+			t.Errorf("ClientHello server name should be %q, got %q\n", name, sni)
+		}
+	}
+
+	if _, err := parseClientHelloSNI([]byte{tlsHandshakeClientHello, 0, 0}); err == nil {
+		t.Error("truncated ClientHello should report error")
+	}
+}
+
+func tlsTestRecord(typ byte, fragment []byte) []byte {
+	n := len(fragment)
+	return append([]byte{typ, 3, 3, byte(n >> 8), byte(n)}, fragment...)
+}
+
+func tlsTestHandshakeMsg(typ byte, bodyLen int) []byte {
+	msg := []byte{typ, byte(bodyLen >> 16), byte(bodyLen >> 8), byte(bodyLen)}
+	return append(msg, make([]byte, bodyLen)...)
+}
+
+func TestTLSServerHandshakeDone(t *testing.T) {
+	hello := tlsTestHandshakeMsg(tlsHandshakeServerHello, 70)
+	cert := tlsTestHandshakeMsg(tlsHandshakeCertificate, 1000)
+	helloCert := tlsTestRecord(tlsRecordHandshake, append(append([]byte(nil), hello...), cert...))
+	// certificate split across 2 records
+	splitCert := append(tlsTestRecord(tlsRecordHandshake, hello),
+		tlsTestRecord(tlsRecordHandshake, cert[:500])...)
+	splitCert = append(splitCert, tlsTestRecord(tlsRecordHandshake, cert[500:])...)
+	tls13 := append(tlsTestRecord(tlsRecordHandshake, hello),
+		tlsTestRecord(tlsRecordChangeCipherSpec, []byte{1})...)
+
+	var testData = []struct {
+		b    []byte
+		done bool
+		err  error
+	}{
+		{helloCert, true, nil},
+		{helloCert[:len(helloCert)-1], false, nil},
+		{helloCert[:3], false, nil},
+		{splitCert, true, nil},
+		{splitCert[:len(splitCert)-1], false, nil},
+		{tls13, true, nil},
+		{tlsTestRecord(tlsRecordHandshake, hello), false, nil},
+		{tlsTestRecord(tlsRecordAlert, []byte{2, 40}), true, nil},
+		{tlsTestRecord(tlsRecordChangeCipherSpec, []byte{1}), false, errTLSMalformed},
+		{[]byte("HTTP/1.1 400 Bad Request\r\n"), false, errTLSMalformed},
+	}
+	for i, td := range testData {
+		done, err := tlsServerHandshakeDone(td.b)
+		if done != td.done || err != td.err {
+			t.Errorf("%d: handshake done should be %v err %v, got %v %v\n", i, td.done, td.err, done, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Transparent proxy for connections redirected by iptables REDIRECT target.
+// The client is not aware of COW, so there's no proxy request. COW finds the
+// original destination from the socket, and the host name from HTTP Host
+// header or TLS SNI. The connection is then handled like a CONNECT request,
+// so direct/parent proxy choice and site statistics work as usual.
+
+type TransparentProxy struct {
+	addr string // listen address, contains port
+}
+
+func NewTransparentProxy(addr string) *TransparentProxy {
+	return &TransparentProxy{addr: addr}
+}
+
+func (py *TransparentProxy) Serve(done chan byte) {
+	defer func() {
+		done <- 1
+	}()
+	ln, err := net.Listen("tcp", py.addr)
+	if err != nil {
+		fmt.Println("Server creation failed:", err)
+		return
+	}
+	info.Printf("COW transparent proxy address %s\n", py.addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			debug.Println("transparent client connection:", err)
+			continue
+		}
+		if debug {
+			debug.Println("new transparent client:", conn.RemoteAddr())
+		}
+		c := newClientConn(conn, nil)
+		c.transparent = true
+		go c.serveTransparent()
+	}
+}
+
+func (c *clientConn) serveTransparent() {
+	var r Request
+	defer func() {
+		r.releaseBuf()
+		c.Close()
+	}()
+
+	dst, err := originalDst(c.Conn)
+	if err != nil {
+		errl.Printf("%s getting original destination: %v\n", c.RemoteAddr(), err)
+		return
+	}
+	if dst.String() == c.LocalAddr().String() {
+		// Connecting to COW directly will make COW connect to itself.
+		errl.Printf("%s connection to transparent proxy is not redirected\n", c.RemoteAddr())
+		return
+	}
+
+	host := c.sniffHost()
+	unsetConnReadTimeout(c, "transparent sniff host")
+
+	var domain string
+	if host == "" {
+		// IP address has no domain, same as in ParseRequestURI
+		host = dst.IP.String()
+	} else {
+		domain = host2Domain(host)
+	}
+	port := fmt.Sprintf("%d", dst.Port)
+	r.initConnect(&URL{net.JoinHostPort(host, port), host, port, domain, ""})
+	if dbgRq {
+		dbgRq.Printf("transparent request from client %s: %s (%s)\n", c.RemoteAddr(), &r, dst)
+	}
+	c.serveConnect(&r)
+}
+
+// For server speaks first protocols such as SMTP and SSH, client sends
+// nothing until getting server greeting, so only wait a short time for the
+// first byte.
+const transparentSniffTimeout = 500 * time.Millisecond
+
+// sniffHost peeks the client's first message to find out the host name. TLS
+// SNI and HTTP Host header are recognized. Returns empty string if host name
+// can't be found. Peeked data are left in the read buffer and will be sent to
+// the server. Caller should unset read timeout.
+func (c *clientConn) sniffHost() string {
+	setConnReadTimeout(c, transparentSniffTimeout, "transparent sniff host")
+	b, err := c.bufRd.Peek(1)
+	if err != nil {
+		if isErrTimeout(err) {
+			debug.Printf("%s sends nothing, maybe server speaks first\n", c.RemoteAddr())
+		}
+		return ""
+	}
+	setConnReadTimeout(c, clientConnTimeout, "transparent sniff host")
+	if b[0] == tlsRecordHandshake {
+		return c.sniffTLSServerName()
+	}
+	return c.sniffHTTPHost()
+}
+
+func (c *clientConn) sniffTLSServerName() string {
+	b, err := c.bufRd.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return ""
+	}
+	if b, err = c.bufRd.Peek(tlsRecordHeaderLen + tlsRecordLen(b)); err != nil {
+		// ClientHello larger than buffer is not likely
+		debug.Printf("%s peek TLS ClientHello: %v\n", c.RemoteAddr(), err)
+		return ""
+	}
+	sni, err := parseClientHelloSNI(b[tlsRecordHeaderLen:])
+	if err != nil {
+		debug.Printf("%s parsing TLS ClientHello: %v\n", c.RemoteAddr(), err)
+	}
+	return sni
+}
+
+func (c *clientConn) sniffHTTPHost() string {
+	for {
+		// check buffered data first, client may send nothing more before
+		// getting response
+		b, _ := c.bufRd.Peek(c.bufRd.Buffered())
+		if host, done := hostFromHTTPHeader(b); done {
+			return host
+		}
+		if _, err := c.bufRd.Peek(len(b) + 1); err != nil {
+			return ""
+		}
+	}
+}
+
+// hostFromHTTPHeader searches Host header in b which contains the beginning
+// of an HTTP request. done is false if more data is needed.
+func hostFromHTTPHeader(b []byte) (host string, done bool) {
+	firstLine := true
+	for {
+		id := bytes.IndexByte(b, '\n')
+		if id == -1 {
+			return "", false
+		}
+		line := TrimSpace(b[:id])
+		b = b[id+1:]
+		if firstLine {
+			firstLine = false
+			if f := FieldsN(line, 3); len(f) != 3 || !bytes.HasPrefix(f[2], []byte("HTTP/")) {
+				// not HTTP
+				return "", true
+			}
+			continue
+		}
+		if len(line) == 0 { // end of headers
+			return "", true
+		}
+		name, val, err := splitHeader(line)
+		if err != nil {
+			return "", true
+		}
+		if string(name) == headerHost {
+			host, _ = splitHostPort(string(TrimSpace(val)))
+			if strings.IndexByte(host, ':') != -1 {
+				// IPv6 address, use the original destination
+				return "", true
+			}
+			return host, true
+		}
+	}
+}
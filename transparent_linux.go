@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST in linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST has the
+// same value.
+const soOriginalDst = 80
+
+const transparentSupported = true
+
+// originalDst returns the destination address of a connection before it's
+// redirected by iptables.
+func originalDst(c net.Conn) (addr *net.TCPAddr, err error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errNotSupported
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := tc.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		// There's no getsockopt for sockaddr in syscall package, use
+		// functions returning structs with the same layout.
+		if ipv6 {
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if sockErr == nil {
+				sa := info.Addr // sockaddr_in6
+				port := ntohs(sa.Port)
+				addr = &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: port}
+			}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if sockErr == nil {
+			sa := mreq.Multiaddr // sockaddr_in: family(2) port(2) addr(4)
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(sa[2])<<8 | int(sa[3]),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// ntohs converts port in sockaddr which is in network byte order.
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
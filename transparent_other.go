@@ -0,0 +1,13 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+const transparentSupported = false
+
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errNotSupported
+}
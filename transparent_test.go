@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostFromHTTPHeader(t *testing.T) {
+	var testData = []struct {
+		header string
+		host   string
+		done   bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: www.g.com\r\n\r\n", "www.g.com", true},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\nhost: g.com:8080\r\n", "g.com", true},
+		{"GET / HTTP/1.1\nHOST:g.com\n", "g.com", true},
+		{"GET / HTTP/1.1\r\nHost: [::1]:80\r\n", "", true},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", "", true},
+		{"SSH-2.0-OpenSSH_6.1\r\n", "", true},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\nHo", "", false},
+		{"GET / HT", "", false},
+	}
+	for _, td := range testData {
+		host, done := hostFromHTTPHeader([]byte(td.header))
+		if host != td.host || done != td.done {
+			t.Errorf("%q got host %q done %v, should be %q %v\n",
+				td.header, host, done, td.host, td.done)
+		}
+	}
+}
+
+func TestSniffHostServerFirst(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	c := newClientConn(srv, nil)
+	defer c.Close()
+
+	start := time.Now()
+	if host := c.sniffHost(); host != "" {
+		t.Error("client sending nothing should have no host, got", host)
+	}
+	if d := time.Since(start); d > 2*transparentSniffTimeout {
+		t.Error("sniffing host for server first protocol takes too long:", d)
+	}
+
+	go cli.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	if host := c.sniffHost(); host != "www.example.com" {
+		t.Error("should sniff host after timeout on first byte, got", host)
+	}
+}
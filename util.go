@@ -236,6 +236,50 @@ func isFileExists(path string) (bool, error) {
 	return false, err
 }
 
+// rotatedFileName returns name of the i-th backup of file, i = 0 for file
+// itself.
+func rotatedFileName(file string, i int) string {
+	if i == 0 {
+		return file
+	}
+	return file + "." + strconv.Itoa(i)
+}
+
+// writeFileRotate writes data to a temporary file and renames it to file,
+// so file is not corrupted if the write fails. Existing file is kept as
+// backup file.1, and file.1 is rotated to file.2 and so on, with at most
+// nbackup backups.
+func writeFileRotate(file string, data []byte, nbackup int) (err error) {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	for i := nbackup; i > 0; i-- {
+		src := rotatedFileName(file, i-1)
+		if exists, _ := isFileExists(src); !exists {
+			continue
+		}
+		if err = os.Rename(src, rotatedFileName(file, i)); err != nil {
+			os.Remove(tmp)
+			return
+		}
+	}
+	return os.Rename(tmp, file)
+}
+
 func isDirExists(path string) (bool, error) {
 	stat, err := os.Stat(path)
 	if err == nil {
@@ -388,8 +432,11 @@ func md5sum(ss ...string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-// only handles IPv4 address now
 func hostIsIP(host string) bool {
+	if strings.IndexByte(host, ':') != -1 {
+		// Host name can't contain ':', so it's IPv6 address.
+		return net.ParseIP(host) != nil
+	}
 	parts := strings.Split(host, ".")
 	if len(parts) != 4 {
 		return false
@@ -424,15 +471,6 @@ func NewNbitIPv4Mask(n int) net.IPMask {
 	return net.IPMask(mask)
 }
 
-var topLevelDomain = map[string]bool{
-	"ac":  true,
-	"co":  true,
-	"org": true,
-	"com": true,
-	"net": true,
-	"edu": true,
-}
-
 func trimLastDot(s string) string {
 	if len(s) > 0 && s[len(s)-1] == '.' {
 		return s[:len(s)-1]
@@ -440,33 +478,57 @@ func trimLastDot(s string) string {
 	return s
 }
 
-// host2Domain returns the domain of a host. It will recognize domains like
-// google.com.hk. Returns empty string for simple host.
+// host2Domain returns the domain of a host, which is the public suffix plus
+// one more label, e.g. google.com.hk, foo.github.io. Returns the host itself
+// if it's a public suffix, and empty string for simple host.
 func host2Domain(host string) (domain string) {
 	host, _ = splitHostPort(host)
 	if hostIsIP(host) {
 		return ""
 	}
 	host = trimLastDot(host)
-	lastDot := strings.LastIndex(host, ".")
+	if strings.IndexByte(host, '.') == -1 {
+		return ""
+	}
+	ps := publicSuffix(strings.ToLower(host))
+	if len(ps) >= len(host) {
+		return host
+	}
+	dot := strings.LastIndexByte(host[:len(host)-len(ps)-1], '.')
+	return host[dot+1:]
+}
+
+// Second level names taken as top level domain before Public Suffix List is
+// used.
+var oldTopLevelDomain = map[string]bool{
+	"ac":  true,
+	"co":  true,
+	"org": true,
+	"com": true,
+	"net": true,
+	"edu": true,
+}
+
+// host2OldDomain returns the domain of a host as given by old versions, so
+// that site lists written for them, containing domains like github.io, still
+// match hosts under such domains.
+func host2OldDomain(host string) (domain string) {
+	host, _ = splitHostPort(host)
+	if hostIsIP(host) {
+		return ""
+	}
+	host = trimLastDot(host)
+	lastDot := strings.LastIndexByte(host, '.')
 	if lastDot == -1 {
 		return ""
 	}
-	// Find the 2nd last dot
-	dot2ndLast := strings.LastIndex(host[:lastDot], ".")
+	dot2ndLast := strings.LastIndexByte(host[:lastDot], '.')
 	if dot2ndLast == -1 {
 		return host
 	}
-
-	part := host[dot2ndLast+1 : lastDot]
-	// If the 2nd last part of a domain name equals to a top level
-	// domain, search for the 3rd part in the host name.
-	// So domains like bbc.co.uk will not be recorded as co.uk
-	if topLevelDomain[part] {
-		dot3rdLast := strings.LastIndex(host[:dot2ndLast], ".")
-		if dot3rdLast == -1 {
-			return host
-		}
+	// bbc.co.uk should not be recorded as co.uk
+	if oldTopLevelDomain[host[dot2ndLast+1:lastDot]] {
+		dot3rdLast := strings.LastIndexByte(host[:dot2ndLast], '.')
 		return host[dot3rdLast+1:]
 	}
 	return host[dot2ndLast+1:]
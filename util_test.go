@@ -330,6 +330,12 @@ func TestHost2Domain(t *testing.T) {
 		{"sina.com.cn", "sina.com.cn"},
 		{"www.bbc.co.uk", "bbc.co.uk"},
 		{"apple.com.cn", "apple.com.cn"},
+		{"foo.github.io", "foo.github.io"},
+		{"a.foo.github.io", "foo.github.io"},
+		{"www.bar.gov.cn", "bar.gov.cn"},
+		{"x.blogspot.com.br", "x.blogspot.com.br"},
+		{"www.Example.COM.", "Example.COM"},
+		{"foo.unknowntld", "foo.unknowntld"},
 		{"simplehost", ""},
 		{"192.168.1.1", ""},
 	}
@@ -342,6 +348,29 @@ func TestHost2Domain(t *testing.T) {
 	}
 }
 
+func TestHost2OldDomain(t *testing.T) {
+	var testData = []struct {
+		host   string
+		domain string
+	}{
+		{"www.google.com", "google.com"},
+		{"www.bbc.co.uk", "bbc.co.uk"},
+		{"foo.github.io", "github.io"},
+		{"x.blogspot.com.br", "blogspot.com.br"},
+		{"github.io", "github.io"},
+		{"co.uk", "co.uk"},
+		{"simplehost", ""},
+		{"192.168.1.1", ""},
+	}
+
+	for _, td := range testData {
+		dm := host2OldDomain(td.host)
+		if dm != td.domain {
+			t.Errorf("%s got old domain %v should be %v", td.host, dm, td.domain)
+		}
+	}
+}
+
 func TestHostIsIP(t *testing.T) {
 	if !hostIsIP("192.168.1.1") {
 		t.Error("192.168.1.1 is ip")
@@ -362,4 +391,12 @@ func TestHostIsIP(t *testing.T) {
 	if hostIsIP("foo.www.google.com") {
 		t.Error("foo.www.google.com is not ip")
 	}
+
+	if !hostIsIP("2001:db8::1") {
+		t.Error("2001:db8::1 is ip")
+	}
+
+	if hostIsIP("2001:db8:::1") {
+		t.Error("2001:db8:::1 is not ip")
+	}
 }